@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// waterfallHandler renders network waterfall of all active connections (or only the one given by id or label).
+func waterfallHandler(res http.ResponseWriter, req *http.Request) {
+	if !*flagWaterfall {
+		http.Error(res, "network waterfall is disabled, run proxy with -waterfall", http.StatusNotFound)
+		return
+	}
+
+	id, label := req.URL.Query().Get("id"), req.URL.Query().Get("label")
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, conn := range activeConnections() {
+		if id != "" && conn.id != id || label != "" && conn.label != label {
+			continue
+		}
+
+		fmt.Fprintf(res, "connection %s from %s\n", conn.id, conn.remoteAddr)
+		fmt.Fprintln(res, strings.Join(conn.renderWaterfall(conn.waterfall.sessions()...), "\n"))
+	}
+}
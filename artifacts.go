@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var artifactExtensions = map[string]string{
+	"image/png":       "png",
+	"image/jpeg":      "jpeg",
+	"image/webp":      "webp",
+	"application/pdf": "pdf",
+}
+
+type screencastFrame struct {
+	path      string
+	timestamp float64
+}
+
+// artifactExtractor decodes screenshots, PDFs and screencast frames into files.
+type artifactExtractor struct {
+	sync.Mutex
+	dir      string
+	counters map[string]int
+	frames   map[string][]screencastFrame
+	// skipped counts screencast frames of each session which can't be decoded into GIF
+	skipped map[string]int
+	// written is notified about every file written by the extractor
+	written func(path string)
+}
+
+func newArtifactExtractor(connectionID string) *artifactExtractor {
+	return &artifactExtractor{
+		dir:      filepath.Join(*flagDirLogs, "artifacts", connectionID),
+		counters: make(map[string]int),
+		frames:   make(map[string][]screencastFrame),
+		skipped:  make(map[string]int),
+	}
+}
+
+func artifactsEnabled() bool {
+	return *flagArtifacts || *flagScreencastGIF
+}
+
+// response extracts artifacts from responses to Page.captureScreenshot and Page.printToPDF,
+// replacing their payload with the path of written file.
+func (a *artifactExtractor) response(sessionID string, request, response *protocolMessage) error {
+	if request == nil || response.Result == nil {
+		return nil
+	}
+
+	var err error
+
+	switch request.Method {
+	case "Page.captureScreenshot":
+		_, err = a.extract(sessionID, "screenshot", response.Result)
+	case "Page.printToPDF":
+		_, err = a.extract(sessionID, "pdf", response.Result)
+	}
+
+	return err
+}
+
+// event extracts frames from Page.screencastFrame events, replacing their payload with the path of written file.
+func (a *artifactExtractor) event(sessionID string, event *protocolMessage) error {
+	if event.Method != "Page.screencastFrame" {
+		return nil
+	}
+
+	path, err := a.extract(sessionID, "screencast", event.Params)
+	if err != nil || path == "" {
+		return err
+	}
+
+	metadata, _ := event.Params["metadata"].(map[string]interface{})
+
+	a.Lock()
+	defer a.Unlock()
+
+	// image package can't decode webp, such frames are only written as files
+	if filepath.Ext(path) == ".webp" {
+		a.skipped[sessionID]++
+		return nil
+	}
+
+	a.frames[sessionID] = append(a.frames[sessionID], screencastFrame{path: path, timestamp: number(metadata, "timestamp")})
+
+	return nil
+}
+
+// extract writes base64 encoded payload to a file and returns its path.
+func (a *artifactExtractor) extract(sessionID, kind string, values map[string]interface{}) (string, error) {
+	encoded, ok := values["data"].(string)
+	if !ok {
+		return "", nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("could not decode %s: %v", kind, err)
+	}
+
+	extension, ok := artifactExtensions[http.DetectContentType(data)]
+	if !ok {
+		extension = "bin"
+	}
+
+	a.Lock()
+	key := sessionID + "/" + kind
+	a.counters[key]++
+	path := filepath.Join(sessionDir(a.dir, sessionID), fmt.Sprintf("%s-%05d.%s", kind, a.counters[key], extension))
+	a.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+
+	if a.written != nil {
+		a.written(path)
+	}
+
+	values["data"] = fmt.Sprintf("%s (%s)", path, formatBytes(float64(len(data))))
+
+	return path, nil
+}
+
+// sessionDir returns directory for artifacts of given session within connection artifacts directory.
+func sessionDir(dir, sessionID string) string {
+	if sessionID == "" {
+		return dir
+	}
+
+	return filepath.Join(dir, sessionID)
+}
+
+// close assembles screencast frames of given session into an animated GIF and returns its path
+// along with number of frames which were left out of it.
+func (a *artifactExtractor) close(sessionID string) (string, int, error) {
+	a.Lock()
+	frames, skipped := a.frames[sessionID], a.skipped[sessionID]
+	delete(a.frames, sessionID)
+	delete(a.skipped, sessionID)
+	a.Unlock()
+
+	if !*flagScreencastGIF || len(frames) == 0 {
+		return "", skipped, nil
+	}
+
+	animation := &gif.GIF{}
+
+	for i, frame := range frames {
+		img, err := readImage(frame.path)
+		if err != nil {
+			return "", skipped, fmt.Errorf("could not read screencast frame %s: %v", frame.path, err)
+		}
+
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+
+		delay := 10
+		if i+1 < len(frames) {
+			delay = int(math.Max(1, math.Round((frames[i+1].timestamp-frame.timestamp)*100)))
+		}
+
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, delay)
+	}
+
+	path := filepath.Join(sessionDir(a.dir, sessionID), "screencast.gif")
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", skipped, err
+	}
+	defer file.Close()
+
+	return path, skipped, gif.EncodeAll(file, animation)
+}
+
+// sessions returns ids of sessions with pending screencast frames.
+func (a *artifactExtractor) sessions() []string {
+	a.Lock()
+	defer a.Unlock()
+
+	var sessions []string
+	for sessionID := range a.frames {
+		sessions = append(sessions, sessionID)
+	}
+
+	for sessionID := range a.skipped {
+		if _, exists := a.frames[sessionID]; !exists {
+			sessions = append(sessions, sessionID)
+		}
+	}
+
+	return sessions
+}
+
+func readImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
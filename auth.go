@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tokenQueryParam = "cpp-token"
+	authRealm       = `Basic realm="chrome-protocol-proxy"`
+)
+
+type identityKey struct{}
+
+type credential struct {
+	identity string
+	secret   string
+}
+
+var authTokens = &argumentList{name: "auth-token", values: []string{}}
+var authBasic = &argumentList{name: "auth-basic", values: []string{}}
+var allowedOrigins = &argumentList{name: "allow-origin", values: []string{}}
+var allowedHosts = &argumentList{name: "allow-host", values: []string{}}
+
+func init() {
+	flag.Var(authTokens, "auth-token", "require bearer token (in Authorization header or cpp-token query parameter) given as <identity>:<token>")
+	flag.Var(authBasic, "auth-basic", "require basic authentication with <user>:<password>")
+	flag.Var(allowedOrigins, "allow-origin", "allow websocket connections only from given Origin (i.e. http://localhost:3000), connections without Origin header are allowed")
+	flag.Var(allowedHosts, "allow-host", "allow only requests with given Host header (i.e. localhost:9223)")
+}
+
+func parseCredentials(values []string) []credential {
+	var credentials []credential
+
+	for i, value := range values {
+		identity, secret, found := strings.Cut(value, ":")
+		if !found {
+			identity, secret = fmt.Sprintf("token-%d", i+1), identity
+		}
+
+		credentials = append(credentials, credential{identity: identity, secret: secret})
+	}
+
+	return credentials
+}
+
+// authenticate rejects requests with disallowed Host, websocket connections from disallowed Origin or requests
+// without valid credentials and passes identity of the authenticated client in request context.
+func authenticate(logger *logrus.Entry, handler http.Handler) http.Handler {
+	tokens := parseCredentials(authTokens.values)
+	users := parseCredentials(authBasic.values)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !allowed(allowedHosts.values, req.Host) {
+			logger.Errorf("rejecting request from %s to %s: host %s is not allowed", req.RemoteAddr, req.URL.Path, req.Host)
+			http.Error(res, "host not allowed", http.StatusForbidden)
+			return
+		}
+
+		// checked before the handler connects to the browser on behalf of the forbidden origin
+		if websocket.IsWebSocketUpgrade(req) && !checkOrigin(req) {
+			logger.Errorf("rejecting connection from %s to %s: origin %s is not allowed", req.RemoteAddr, req.URL.Path, req.Header.Get("Origin"))
+			http.Error(res, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if len(tokens) == 0 && len(users) == 0 {
+			handler.ServeHTTP(res, req)
+			return
+		}
+
+		identity, ok := authorize(req, tokens, users)
+		if !ok {
+			logger.Errorf("rejecting request from %s to %s: invalid credentials", req.RemoteAddr, req.URL.Path)
+
+			if len(users) > 0 {
+				res.Header().Set("WWW-Authenticate", authRealm)
+			}
+
+			http.Error(res, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		query := req.URL.Query()
+		query.Del(tokenQueryParam)
+		req.URL.RawQuery = query.Encode()
+		req.Header.Del("Authorization")
+
+		handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), identityKey{}, identity)))
+	})
+}
+
+func authorize(req *http.Request, tokens, users []credential) (string, bool) {
+	if user, password, ok := req.BasicAuth(); ok {
+		for _, credential := range users {
+			if credential.identity == user && secure(credential.secret, password) {
+				return user, true
+			}
+		}
+
+		return "", false
+	}
+
+	token := req.URL.Query().Get(tokenQueryParam)
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if token == "" {
+		return "", false
+	}
+
+	for _, credential := range tokens {
+		if secure(credential.secret, token) {
+			return credential.identity, true
+		}
+	}
+
+	return "", false
+}
+
+func secure(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// identityFrom returns identity of the client authenticated with given request.
+func identityFrom(req *http.Request) string {
+	identity, _ := req.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+// checkOrigin allows websocket connections only from allowed origins, if any are configured.
+// Connections without Origin header don't come from web pages and are allowed.
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || len(allowedOrigins.values) == 0 {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return allowed(allowedOrigins.values, origin) || allowed(allowedOrigins.values, parsed.Host)
+}
+
+// allowed reports whether value (host with optional port or origin) is on allowlist, allowing anything if allowlist is empty.
+func allowed(allowlist []string, value string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		host = value
+	}
+
+	for _, allowed := range allowlist {
+		if strings.EqualFold(allowed, value) || strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// issuedCommandID is the first id of commands issued by the proxy itself, kept within 32-bit range accepted by the browser.
+	issuedCommandID = 2000000000
+	issuedTimeout   = 5 * time.Second
+)
+
+var errIssuedTimeout = errors.New("timeout waiting for response")
+
+// call sends command issued by the proxy itself to the browser and waits for the response,
+// which is not forwarded to the client.
+func (c *connection) call(method string, params map[string]interface{}) (*protocolMessage, error) {
+	c.Lock()
+	c.lastIssued++
+	id := issuedCommandID + c.lastIssued
+	// commands are issued to the browser itself, so responses within sessions don't match them
+	key := commandKey("", id)
+	response := make(chan *protocolMessage, 1)
+	c.issued[key] = response
+	c.Unlock()
+
+	defer func() {
+		c.Lock()
+		delete(c.issued, key)
+		c.Unlock()
+	}()
+
+	data, err := json.Marshal(map[string]interface{}{"id": id, "method": method, "params": params})
+	if err != nil {
+		return nil, err
+	}
+
+	if msg, err := decodeMessage(data); err == nil {
+		c.publish(msg)
+	}
+
+	if err := c.browser.WriteMessage(websocket.TextMessage, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-response:
+		if msg.IsError() {
+			return msg, fmt.Errorf("%s (%d)", msg.Error.Message, msg.Error.Code)
+		}
+
+		return msg, nil
+
+	case <-time.After(issuedTimeout):
+		return nil, errIssuedTimeout
+	}
+}
+
+// resolve passes response to the command issued by the proxy to the waiting caller and reports whether it did.
+func (c *connection) resolve(msg *protocolMessage) bool {
+	if msg.ID < issuedCommandID || !msg.IsResponse() {
+		return false
+	}
+
+	c.Lock()
+	response, ok := c.issued[commandKey(msg.SessionId, msg.ID)]
+	c.Unlock()
+
+	if ok {
+		response <- msg
+	}
+
+	return ok
+}
+
+// cleanup closes targets and disposes browser contexts created by the client which went away.
+func (c *connection) cleanup() {
+	targets, contexts := c.owned.owned()
+
+	for _, targetID := range targets {
+		if _, err := c.call("Target.closeTarget", map[string]interface{}{"targetId": targetID}); err != nil {
+			c.logger.Errorf("cleanup: could not close target %s: %v", targetID, err)
+		} else {
+			c.logger.Infof("cleanup: closed target %s", targetID)
+		}
+	}
+
+	for _, contextID := range contexts {
+		if _, err := c.call("Target.disposeBrowserContext", map[string]interface{}{"browserContextId": contextID}); err != nil {
+			c.logger.Errorf("cleanup: could not dispose browser context %s: %v", contextID, err)
+		} else {
+			c.logger.Infof("cleanup: disposed browser context %s", contextID)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func TestResolveMatchesSessionOfIssuedCommand(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	conn := newConnection("test", "127.0.0.1:1", logrus.NewEntry(logger))
+	browser := &recordingConn{}
+	conn.browser = newWsWriter(browser)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.call("Target.getTargets", nil)
+		result <- err
+	}()
+
+	issued := func() int {
+		conn.Lock()
+		defer conn.Unlock()
+
+		return len(conn.issued)
+	}
+
+	for deadline := time.Now().Add(time.Second); issued() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	sessionResponse, _ := decodeMessage([]byte(`{"id":2000000001,"sessionId":"S1","result":{}}`))
+	if conn.resolve(sessionResponse) {
+		t.Fatal("expected response within session not to resolve command issued to the browser")
+	}
+
+	response, _ := decodeMessage([]byte(`{"id":2000000001,"result":{}}`))
+	if !conn.resolve(response) {
+		t.Fatal("expected response of the browser to resolve issued command")
+	}
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingConn is a client which stays connected until it is closed.
+type blockingConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (b *blockingConn) ReadMessage() (int, []byte, error) {
+	<-b.closed
+	return 0, nil, io.EOF
+}
+
+func (b *blockingConn) WriteMessage(messageType int, data []byte) error {
+	return nil
+}
+
+func (b *blockingConn) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// answeringBrowser answers every command with an empty result.
+type answeringBrowser struct {
+	responses chan []byte
+}
+
+func (b *answeringBrowser) ReadMessage() (int, []byte, error) {
+	data, ok := <-b.responses
+	if !ok {
+		return 0, nil, io.EOF
+	}
+
+	return websocket.TextMessage, data, nil
+}
+
+func (b *answeringBrowser) WriteMessage(messageType int, data []byte) error {
+	command, err := decodeMessage(data)
+	if err != nil {
+		return err
+	}
+
+	b.responses <- []byte(fmt.Sprintf(`{"id":%d,"result":{}}`, command.ID))
+	return nil
+}
+
+func (b *answeringBrowser) Close() error {
+	return nil
+}
+
+func TestCleanupOnShutdown(t *testing.T) {
+	previous := *flagCleanup
+	*flagCleanup = true
+	defer func() { *flagCleanup = previous }()
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	conn := newConnection("test", "127.0.0.1:1", logrus.NewEntry(logger))
+	conn.owned.targets["T1"], conn.owned.targets["T2"] = true, true
+
+	client, browser := &blockingConn{closed: make(chan struct{})}, &answeringBrowser{responses: make(chan []byte, 16)}
+	defer client.Close()
+	defer close(browser.responses)
+
+	conn.client, conn.browser = newWsWriter(client), newWsWriter(browser)
+
+	// proxy is shutting down
+	ctxt, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	started := time.Now()
+	if _, err := conn.run(ctxt, client, browser); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(started); elapsed > issuedTimeout/2 {
+		t.Fatalf("expected targets to be cleaned up quickly on shutdown, took %s", elapsed)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connection holds state of a single proxied DevTools connection.
+type connection struct {
+	sync.Mutex
+	id         string
+	remoteAddr string
+	identity   string
+	label      string
+	path       string
+	version    map[string]string
+	started    time.Time
+	messages   atomic.Int64
+	errors     atomic.Int64
+	lastFrame  atomic.Int64
+	stream     chan *protocolMessage
+	logger     *logrus.Entry
+	registry   *targetRegistry
+	waterfall  *networkWaterfall
+	artifacts  *artifactExtractor
+	traces     *traceCollector
+	recorder   *recorder
+	abnormal   string
+
+	client       *wsWriter
+	browser      *wsWriter
+	interceptors []interceptor
+	commands     map[string]*protocolMessage
+	sent         map[string]time.Time
+	owned        *ownership
+	quota        *quotaEnforcer
+	issued       map[string]chan *protocolMessage
+	lastIssued   uint64
+	resumeToken  string
+	resumes      chan messageConn
+	ended        chan struct{}
+	expired      chan error
+	files        []string
+	written      map[string]bool
+
+	streamLock   sync.Mutex
+	streamClosed bool
+}
+
+func newConnection(id, remoteAddr string, logger *logrus.Entry) *connection {
+	conn := &connection{
+		id:         id,
+		remoteAddr: remoteAddr,
+		started:    time.Now(),
+		stream:     make(chan *protocolMessage, 1024),
+		logger:     logger,
+		registry:   newTargetRegistry(),
+		waterfall:  newNetworkWaterfall(),
+		artifacts:  newArtifactExtractor(id),
+		traces:     newTraceCollector(id),
+		commands:   make(map[string]*protocolMessage),
+		sent:       make(map[string]time.Time),
+		issued:     make(map[string]chan *protocolMessage),
+		owned:      newOwnership(),
+		resumes:    make(chan messageConn),
+		ended:      make(chan struct{}),
+		expired:    make(chan error, 1),
+		written:    make(map[string]bool),
+	}
+
+	conn.artifacts.written = conn.wrote
+
+	conn.lastFrame.Store(conn.started.UnixNano())
+
+	if flightRecorder != nil {
+		conn.recorder = newRecorder(conn)
+	}
+
+	return conn
+}
+
+// setupInterceptors configures interceptors of proxied frames, including ones requested in query of the client connection.
+func (c *connection) setupInterceptors(query url.Values) error {
+	quota := newQuotaEnforcer(c)
+
+	c.Lock()
+	c.quota = quota
+	c.Unlock()
+
+	if commandPolicy != nil || quota != nil || *flagCleanup {
+		c.interceptors = append(c.interceptors, c.owned)
+	}
+
+	if commandPolicy != nil {
+		c.interceptors = append(c.interceptors, &policyEnforcer{conn: c, policy: commandPolicy})
+	}
+
+	if quota != nil {
+		c.interceptors = append(c.interceptors, quota)
+	}
+
+	injector, err := newFaultInjector(c, query)
+	if err != nil {
+		return err
+	}
+
+	if injector != nil {
+		c.interceptors = append(c.interceptors, injector)
+	}
+
+	return nil
+}
+
+// pendingCommands returns number of commands with given method (or any, except envelopes) sent to the browser
+// and not answered yet.
+func (c *connection) pendingCommands(method string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	pending := 0
+	for _, command := range c.commands {
+		if (method == "" && command.Method != "Target.sendMessageToTarget") || command.Method == method {
+			pending++
+		}
+	}
+
+	return pending
+}
+
+// targets returns number of targets created by the client, including ones which are being created.
+func (c *connection) targets() int {
+	targets, _ := c.owned.owned()
+	return len(targets) + c.pendingCommands("Target.createTarget")
+}
+
+// sessionLabel returns human-readable label of given session or id of the connection for the browser session.
+func (c *connection) sessionLabel(sessionID string) string {
+	if sessionID == "" {
+		return c.id
+	}
+
+	return c.registry.path(sessionID)
+}
+
+// publish passes message to the stream of logged messages unless it is already closed.
+func (c *connection) publish(msg *protocolMessage) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+
+	c.messages.Add(1)
+	if msg.IsError() {
+		c.errors.Add(1)
+	}
+
+	if !c.streamClosed {
+		c.stream <- msg
+	}
+}
+
+// closeStream closes stream of logged messages so that it can be drained.
+func (c *connection) closeStream() {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+
+	if !c.streamClosed {
+		c.streamClosed = true
+		close(c.stream)
+	}
+}
+
+// renderWaterfall renders network waterfall of given sessions.
+func (c *connection) renderWaterfall(sessionIDs ...string) []string {
+	var lines []string
+
+	for _, sessionID := range sessionIDs {
+		lines = append(lines, c.waterfall.render(sessionID, c.sessionLabel(sessionID))...)
+	}
+
+	return lines
+}
+
+// logWaterfall renders network waterfall of given sessions into connection log and returns rendered lines.
+func (c *connection) logWaterfall(sessionIDs ...string) []string {
+	lines := c.renderWaterfall(sessionIDs...)
+
+	for _, line := range lines {
+		c.logger.WithFields(logrus.Fields{
+			fieldLevel: levelConnection,
+		}).Info(line)
+	}
+
+	return lines
+}
+
+// closeArtifacts assembles screencasts of given sessions and logs where they were written.
+func (c *connection) closeArtifacts(sessionIDs ...string) {
+	for _, sessionID := range sessionIDs {
+		path, skipped, err := c.artifacts.close(sessionID)
+
+		if skipped > 0 && *flagScreencastGIF {
+			c.logger.WithFields(logrus.Fields{
+				fieldLevel: levelConnection,
+			}).Warnf("%d webp screencast frames of %s were left out of GIF, request screencast in png or jpeg format", skipped, c.sessionLabel(sessionID))
+		}
+
+		c.logArtifact("screencast", sessionID, path, err)
+	}
+}
+
+// logArtifact logs where artifact of given session was written or why it could not be written.
+func (c *connection) logArtifact(kind, sessionID, path string, err error) {
+	label := c.sessionLabel(sessionID)
+
+	if err != nil {
+		c.logger.WithFields(logrus.Fields{
+			fieldLevel: levelConnection,
+		}).Errorf("could not write %s of %s: %v", kind, label, err)
+	} else if path != "" {
+		c.wrote(path)
+		c.logger.WithFields(logrus.Fields{
+			fieldLevel: levelConnection,
+		}).Infof("%s of %s written to %s", kind, label, path)
+	}
+}
+
+var connections = struct {
+	sync.Mutex
+	active map[string]*connection
+}{active: make(map[string]*connection)}
+
+func registerConnection(conn *connection) {
+	connections.Lock()
+	defer connections.Unlock()
+
+	connections.active[conn.id] = conn
+}
+
+func unregisterConnection(conn *connection) {
+	connections.Lock()
+	defer connections.Unlock()
+
+	if connections.active[conn.id] == conn {
+		delete(connections.active, conn.id)
+	}
+}
+
+// activeConnections returns currently proxied connections ordered by start time.
+func activeConnections() []*connection {
+	connections.Lock()
+	defer connections.Unlock()
+
+	active := make([]*connection, 0, len(connections.active))
+	for _, conn := range connections.active {
+		active = append(active, conn)
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].started.Before(active[j].started)
+	})
+
+	return active
+}
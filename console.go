@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	consoleStackDepth   = 10
+	consolePreviewWidth = 5
+)
+
+type consoleEntry struct {
+	level    string
+	text     string
+	location string
+	stack    []string
+}
+
+func (e *consoleEntry) String() string {
+	message := e.text
+
+	if e.location != "" {
+		message += " (" + e.location + ")"
+	}
+
+	for _, frame := range e.stack {
+		message += "\n\tat " + frame
+	}
+
+	return message
+}
+
+func (e *consoleEntry) isError() bool {
+	return e.level == "error" || e.level == "exception" || e.level == "assert"
+}
+
+// consoleMessage extracts readable console entry from Runtime and Log domain events.
+func consoleMessage(msg *protocolMessage) (*consoleEntry, bool) {
+	switch msg.Method {
+	case "Runtime.consoleAPICalled":
+		args, _ := msg.Params["args"].([]interface{})
+		stack, _ := msg.Params["stackTrace"].(map[string]interface{})
+		level := asString(msg.Params["type"])
+
+		entry := &consoleEntry{level: level, text: formatConsoleArguments(args), location: stackLocation(stack)}
+		if level == "error" || level == "trace" || level == "assert" {
+			entry.stack = formatStackTrace(stack)
+		}
+
+		return entry, true
+
+	case "Runtime.exceptionThrown":
+		details, _ := msg.Params["exceptionDetails"].(map[string]interface{})
+		exception, _ := details["exception"].(map[string]interface{})
+		stack, _ := details["stackTrace"].(map[string]interface{})
+
+		text := asString(details["text"])
+		if description, ok := exception["description"].(string); ok {
+			text += " " + strings.SplitN(description, "\n", 2)[0]
+		} else if exception != nil {
+			text += " " + formatRemoteObject(exception, false)
+		}
+
+		entry := &consoleEntry{level: "exception", text: text, stack: formatStackTrace(stack)}
+		if url, ok := details["url"].(string); ok && url != "" {
+			entry.location = fmt.Sprintf("%s:%d:%d", url, int(number(details, "lineNumber"))+1, int(number(details, "columnNumber"))+1)
+		} else {
+			entry.location = stackLocation(stack)
+		}
+
+		return entry, true
+
+	case "Runtime.exceptionRevoked":
+		return &consoleEntry{
+			level: "revoked",
+			text:  fmt.Sprintf("exception #%d revoked: %s", int(number(msg.Params, "exceptionId")), asString(msg.Params["reason"])),
+		}, true
+
+	case "Log.entryAdded":
+		details, _ := msg.Params["entry"].(map[string]interface{})
+		stack, _ := details["stackTrace"].(map[string]interface{})
+
+		entry := &consoleEntry{
+			level: asString(details["level"]),
+			text:  fmt.Sprintf("[%s] %s", asString(details["source"]), asString(details["text"])),
+		}
+
+		if url, ok := details["url"].(string); ok && url != "" {
+			entry.location = url
+
+			if _, ok := details["lineNumber"]; ok {
+				entry.location = fmt.Sprintf("%s:%d", url, int(number(details, "lineNumber"))+1)
+			}
+		}
+
+		if entry.isError() {
+			entry.stack = formatStackTrace(stack)
+		}
+
+		return entry, true
+	}
+
+	return nil, false
+}
+
+// formatConsoleArguments formats console API arguments the way DevTools console does, including format specifiers.
+func formatConsoleArguments(args []interface{}) string {
+	var parts []string
+
+	if len(args) > 0 {
+		if first, ok := args[0].(map[string]interface{}); ok && first["type"] == "string" && strings.Contains(asString(first["value"]), "%") {
+			var formatted string
+			formatted, args = formatSpecifiers(asString(first["value"]), args[1:])
+			parts = append(parts, formatted)
+		}
+	}
+
+	for _, arg := range args {
+		if object, ok := arg.(map[string]interface{}); ok {
+			parts = append(parts, formatRemoteObject(object, false))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func formatSpecifiers(format string, args []interface{}) (string, []interface{}) {
+	var builder strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			builder.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		specifier := format[i]
+
+		if specifier == '%' {
+			builder.WriteByte('%')
+			continue
+		}
+
+		if !strings.ContainsRune("sdifoOc", rune(specifier)) || len(args) == 0 {
+			builder.WriteByte('%')
+			builder.WriteByte(specifier)
+			continue
+		}
+
+		object, _ := args[0].(map[string]interface{})
+		args = args[1:]
+
+		switch specifier {
+		case 's', 'o', 'O':
+			builder.WriteString(formatRemoteObject(object, false))
+		case 'd', 'i':
+			builder.WriteString(fmt.Sprintf("%d", int64(number(object, "value"))))
+		case 'f':
+			builder.WriteString(fmt.Sprintf("%v", number(object, "value")))
+		}
+	}
+
+	return builder.String(), args
+}
+
+// formatRemoteObject formats Runtime.RemoteObject using its value, preview or description.
+func formatRemoteObject(object map[string]interface{}, nested bool) string {
+	if object == nil {
+		return ""
+	}
+
+	if value, ok := object["unserializableValue"].(string); ok {
+		return value
+	}
+
+	switch asString(object["type"]) {
+	case "undefined":
+		return "undefined"
+	case "string":
+		if nested {
+			return fmt.Sprintf("%q", asString(object["value"]))
+		}
+
+		return asString(object["value"])
+	case "number", "boolean":
+		return asString(object["value"])
+	case "object":
+		if object["subtype"] == "null" {
+			return "null"
+		}
+
+		if preview, ok := object["preview"].(map[string]interface{}); ok && !nested {
+			return formatObjectPreview(preview)
+		}
+	}
+
+	if description, ok := object["description"].(string); ok {
+		return strings.SplitN(description, "\n", 2)[0]
+	}
+
+	if value, ok := object["value"]; ok {
+		return serialize(value)
+	}
+
+	return asString(object["type"])
+}
+
+func formatObjectPreview(preview map[string]interface{}) string {
+	properties, _ := preview["properties"].([]interface{})
+	description := asString(preview["description"])
+	isArray := preview["subtype"] == "array"
+
+	var parts []string
+	for i, value := range properties {
+		if i == consolePreviewWidth {
+			break
+		}
+
+		property, _ := value.(map[string]interface{})
+		formatted := asString(property["value"])
+
+		if property["type"] == "string" {
+			formatted = fmt.Sprintf("%q", formatted)
+		}
+
+		if isArray {
+			parts = append(parts, formatted)
+		} else {
+			parts = append(parts, asString(property["name"])+": "+formatted)
+		}
+	}
+
+	if preview["overflow"] == true || len(properties) > consolePreviewWidth {
+		parts = append(parts, "...")
+	}
+
+	if isArray {
+		return description + " [" + strings.Join(parts, ", ") + "]"
+	}
+
+	if description == "Object" {
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+
+	return description + " {" + strings.Join(parts, ", ") + "}"
+}
+
+func formatStackTrace(stack map[string]interface{}) []string {
+	frames, _ := stack["callFrames"].([]interface{})
+
+	var lines []string
+	for i, value := range frames {
+		if i == consoleStackDepth {
+			lines = append(lines, fmt.Sprintf("... %d more", len(frames)-consoleStackDepth))
+			break
+		}
+
+		frame, _ := value.(map[string]interface{})
+		function := asString(frame["functionName"])
+		if function == "" {
+			function = "(anonymous)"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s (%s)", function, frameLocation(frame)))
+	}
+
+	return lines
+}
+
+func stackLocation(stack map[string]interface{}) string {
+	if frames, ok := stack["callFrames"].([]interface{}); ok && len(frames) > 0 {
+		if frame, ok := frames[0].(map[string]interface{}); ok {
+			return frameLocation(frame)
+		}
+	}
+
+	return ""
+}
+
+func frameLocation(frame map[string]interface{}) string {
+	return fmt.Sprintf("%s:%d:%d", asString(frame["url"]), int(number(frame, "lineNumber"))+1, int(number(frame, "columnNumber"))+1)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	controlWriteTimeout = time.Second
+	// closeReasonLimit is the longest reason which fits into close frame.
+	closeReasonLimit = 123
+)
+
+// control writes control frame if connection is a websocket which is not suspended and reports whether it did.
+func (w *wsWriter) control(messageType int, data []byte) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	ws, ok := w.conn.(*websocket.Conn)
+	if !ok || w.suspended {
+		return false
+	}
+
+	return ws.WriteControl(messageType, data, time.Now().Add(controlWriteTimeout)) == nil
+}
+
+// closeWith sends close frame with given code and reason if connection is a websocket.
+func (w *wsWriter) closeWith(code int, reason string) {
+	reason = truncate(reason, closeReasonLimit)
+
+	w.control(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// watchClient relays pings and pongs of the client to the browser, unless the proxy keeps the connection alive itself.
+func (c *connection) watchClient(in messageConn) {
+	ws, ok := in.(*websocket.Conn)
+	if !ok {
+		return
+	}
+
+	if *flagKeepalive > 0 {
+		ws.SetReadDeadline(time.Now().Add(2 * *flagKeepalive))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(2 * *flagKeepalive))
+		})
+
+		return
+	}
+
+	ws.SetPingHandler(func(data string) error {
+		c.logger.Infof("client ping %q", data)
+
+		// browser over pipe can't be pinged, the proxy answers instead
+		if !c.browser.control(websocket.PingMessage, []byte(data)) {
+			c.client.control(websocket.PongMessage, []byte(data))
+		}
+
+		return nil
+	})
+
+	ws.SetPongHandler(func(data string) error {
+		c.logger.Infof("client pong %q", data)
+		c.browser.control(websocket.PongMessage, []byte(data))
+
+		return nil
+	})
+}
+
+// watchBrowser relays pings and pongs of the browser to the client, unless the proxy keeps the connection alive itself.
+func (c *connection) watchBrowser(out messageConn) {
+	ws, ok := out.(*websocket.Conn)
+	if !ok || *flagKeepalive > 0 {
+		return
+	}
+
+	ws.SetPingHandler(func(data string) error {
+		c.logger.Infof("browser ping %q", data)
+
+		// client which is disconnected can't answer, the proxy does instead
+		if !c.client.control(websocket.PingMessage, []byte(data)) {
+			c.browser.control(websocket.PongMessage, []byte(data))
+		}
+
+		return nil
+	})
+
+	ws.SetPongHandler(func(data string) error {
+		c.logger.Infof("browser pong %q", data)
+		c.client.control(websocket.PongMessage, []byte(data))
+
+		return nil
+	})
+}
+
+// keepAlive pings the client and the browser every -keepalive until the connection is closed.
+// Client which does not answer is disconnected.
+func (c *connection) keepAlive(ctxt context.Context) {
+	ticker := time.NewTicker(*flagKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.client.control(websocket.PingMessage, nil)
+			c.browser.control(websocket.PingMessage, nil)
+
+		case <-ctxt.Done():
+			return
+		}
+	}
+}
+
+// propagateClose logs why one side of the connection went away and closes the other side with the same close code and reason.
+// Side which failed is given by direction of the messages read from it.
+func (c *connection) propagateClose(dir direction, err error) {
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		c.abnormal = err.Error()
+		c.logger.Errorf("closing connection: %v", err)
+		c.client.closeWith(websocket.CloseGoingAway, err.Error())
+		c.browser.closeWith(websocket.CloseNormalClosure, "")
+		return
+	}
+
+	closing, closed := "client", c.browser
+	if dir == toClient {
+		closing, closed = "browser", c.client
+	}
+
+	code, reason := websocket.CloseInternalServerErr, err.Error()
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		code, reason = closeErr.Code, closeErr.Text
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && dir == toBrowser {
+		c.logger.Infof("client did not answer ping within %s", 2**flagKeepalive)
+	} else {
+		c.logger.Infof("%s closed connection: %v", closing, err)
+	}
+
+	lost := closeErr == nil
+
+	// codes of connections which were not closed with close frame can't be sent in one
+	switch code {
+	case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		code, reason, lost = websocket.CloseGoingAway, closing+" connection lost", true
+	}
+
+	if lost {
+		c.abnormal = fmt.Sprintf("%s connection lost: %v", closing, err)
+	}
+
+	closed.closeWith(code, reason)
+}
@@ -1,4 +1,2 @@
 #!/bin/sh
-chromium-browser --headless --disable-gpu --disable-software-rasterizer --disable-dev-shm-usage --no-sandbox --remote-debugging-address=0.0.0.0 --remote-debugging-port=9223 --no-sandbox &
-
-./chrome-protocol-proxy -l 0.0.0.0:9222 -r localhost:9223 "$@"
+exec ./chrome-protocol-proxy -l 0.0.0.0:9222 -r localhost:9223 -launch "chromium-browser --headless --disable-gpu --disable-software-rasterizer --disable-dev-shm-usage --no-sandbox --remote-debugging-address=127.0.0.1" "$@"
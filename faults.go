@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	faultErrorCode      = -32000
+	faultErrorMessage   = "Fault injected by chrome-protocol-proxy"
+	faultReorderTimeout = 500 * time.Millisecond
+	faultQueryParam     = "cpp-fault"
+	faultSeedQueryParam = "cpp-fault-seed"
+)
+
+var faultRules = &argumentList{name: "fault", values: []string{}}
+
+func init() {
+	flag.Var(faultRules, "fault", "inject fault: delay:<method>:<duration>, error:<method>[:<code>[:<message>]], drop:<method>, duplicate:<method>, reorder:<method>, close-after:<frames> or close-on:<method>, optionally followed by @<probability>")
+}
+
+type faultRule struct {
+	definition  string
+	action      string
+	method      string
+	delay       time.Duration
+	code        int64
+	message     string
+	frames      int
+	probability float64
+}
+
+func parseFaultRule(definition string) (*faultRule, error) {
+	rule := &faultRule{definition: definition, probability: 1, code: faultErrorCode, message: faultErrorMessage}
+	value := definition
+
+	if at := strings.LastIndex(value, "@"); at != -1 {
+		probability, err := strconv.ParseFloat(value[at+1:], 64)
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("invalid fault %q: probability must be between 0 and 1", definition)
+		}
+
+		rule.probability = probability
+		value = value[:at]
+	}
+
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid fault %q", definition)
+	}
+
+	rule.action = parts[0]
+	rule.method = parts[1]
+
+	switch rule.action {
+	case "delay":
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("invalid fault %q: missing delay", definition)
+		}
+
+		delay, err := time.ParseDuration(strings.Join(parts[2:], ":"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %v", definition, err)
+		}
+
+		rule.delay = delay
+
+	case "error":
+		if len(parts) > 2 {
+			code, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault %q: %v", definition, err)
+			}
+
+			rule.code = code
+		}
+
+		if len(parts) > 3 {
+			rule.message = parts[3]
+		}
+
+	case "close-after":
+		frames, err := strconv.Atoi(parts[1])
+		if err != nil || frames <= 0 {
+			return nil, fmt.Errorf("invalid fault %q: number of frames expected", definition)
+		}
+
+		rule.method = ""
+		rule.frames = frames
+
+	case "drop", "duplicate", "reorder", "close-on":
+	default:
+		return nil, fmt.Errorf("invalid fault %q: unknown action %s", definition, rule.action)
+	}
+
+	return rule, nil
+}
+
+// faultInjector misbehaves on purpose according to configured rules to test resilience of clients.
+type faultInjector struct {
+	sync.Mutex
+	conn   *connection
+	rules  []*faultRule
+	random *rand.Rand
+	frames int
+	held   *frame
+}
+
+// newFaultInjector creates injector with rules from flags and from query of the client connection,
+// returning nil if there are no rules configured.
+func newFaultInjector(conn *connection, query url.Values) (*faultInjector, error) {
+	definitions := append(append([]string{}, faultRules.values...), query[faultQueryParam]...)
+	if len(definitions) == 0 {
+		return nil, nil
+	}
+
+	injector := &faultInjector{conn: conn}
+
+	for _, definition := range definitions {
+		rule, err := parseFaultRule(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		injector.rules = append(injector.rules, rule)
+	}
+
+	seed := *flagFaultSeed
+	if value := query.Get(faultSeedQueryParam); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", faultSeedQueryParam, err)
+		}
+
+		seed = parsed
+	}
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	injector.random = rand.New(rand.NewSource(seed))
+	conn.logger.Infof("injecting faults %s with seed %d", strings.Join(definitions, ", "), seed)
+
+	return injector, nil
+}
+
+func (i *faultInjector) intercept(dir direction, f *frame) (bool, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.frames++
+	msg := f.message()
+
+	for _, rule := range i.rules {
+		if !i.matches(rule, dir, f, msg) || i.random.Float64() >= rule.probability {
+			continue
+		}
+
+		switch rule.action {
+		case "close-after", "close-on":
+			i.log(rule, "closing client connection after %d frames", i.frames)
+			return true, i.conn.client.Close()
+
+		case "error":
+			i.log(rule, "replying with error to %s", f.method())
+			return true, i.conn.replyError(f, rule.code, rule.message)
+
+		case "drop":
+			i.log(rule, "dropping %s", f.method())
+			return true, nil
+
+		case "duplicate":
+			i.log(rule, "duplicating %s", f.method())
+			if err := i.conn.deliver(dir, f); err != nil {
+				return true, err
+			}
+
+			return true, i.conn.deliver(dir, f)
+
+		case "delay":
+			i.log(rule, "delaying %s by %s", f.method(), rule.delay)
+			time.AfterFunc(rule.delay, func() {
+				_ = i.conn.deliver(dir, f)
+			})
+
+			return true, nil
+
+		case "reorder":
+			if i.held != nil {
+				continue
+			}
+
+			i.log(rule, "reordering %s", f.method())
+			i.held = f
+			time.AfterFunc(faultReorderTimeout, i.release)
+
+			return true, nil
+		}
+	}
+
+	if i.held != nil && dir == toClient {
+		held := i.held
+		i.held = nil
+
+		if err := i.conn.deliver(dir, f); err != nil {
+			return true, err
+		}
+
+		return true, i.conn.deliver(toClient, held)
+	}
+
+	return false, nil
+}
+
+func (i *faultInjector) matches(rule *faultRule, dir direction, f *frame, msg *protocolMessage) bool {
+	if rule.action == "close-after" {
+		return i.frames > rule.frames
+	}
+
+	if msg == nil || !matchMethod(rule.method, f.method()) {
+		return false
+	}
+
+	switch rule.action {
+	case "error":
+		return dir == toBrowser && msg.IsRequest()
+	case "close-on":
+		return (dir == toBrowser && msg.IsRequest()) || (dir == toClient && msg.IsEvent())
+	}
+
+	// dropped, duplicated or reordered responses would leave clients waiting or answer commands twice
+	return dir == toClient && msg.IsEvent()
+}
+
+// release delivers held frame if it was not delivered after another one in the meantime.
+func (i *faultInjector) release() {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.held != nil {
+		_ = i.conn.deliver(toClient, i.held)
+		i.held = nil
+	}
+}
+
+func (i *faultInjector) log(rule *faultRule, format string, args ...interface{}) {
+	i.conn.logger.Errorf("fault injection (%s): %s", rule.definition, fmt.Sprintf(format, args...))
+}
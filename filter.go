@@ -24,29 +24,53 @@ var filterInclude = &argumentList{name: "include", values: []string{}}
 var filterExclude = &argumentList{name: "exclude", values: []string{}}
 
 func init() {
-	flag.Var(filterInclude, "include", "display only requests/responses/events matching pattern")
-	flag.Var(filterExclude, "exclude", "exclude requests/responses/events matching pattern")
+	flag.Var(filterInclude, "include", "display only requests/responses/events matching pattern (or of connections labelled label:<label>)")
+	flag.Var(filterExclude, "exclude", "exclude requests/responses/events matching pattern (or of connections labelled label:<label>)")
 }
 
-func accept(values ...string) bool {
+// accept reports whether message should be displayed. Patterns prefixed with label: match label of the connection
+// and apply only to messages logged for a connection.
+func accept(label string, labelled bool, values ...string) bool {
 
 	value := strings.Join(values, "")
 
 	for _, exclude := range filterExclude.values {
-		if strings.Contains(value, exclude) {
+		if matches(exclude, label, labelled, value) {
 			return false
 		}
 	}
 
-	if len(filterInclude.values) == 0 {
+	var labels, patterns []string
+	for _, include := range filterInclude.values {
+		if strings.HasPrefix(include, labelFilterPrefix) {
+			labels = append(labels, include)
+		} else {
+			patterns = append(patterns, include)
+		}
+	}
+
+	return (!labelled || matchesAnyOf(labels, label, labelled, value)) && matchesAnyOf(patterns, label, labelled, value)
+}
+
+// matchesAnyOf reports whether value matches one of the patterns, accepting everything when there are none.
+func matchesAnyOf(patterns []string, label string, labelled bool, value string) bool {
+	if len(patterns) == 0 {
 		return true
 	}
 
-	for _, include := range filterInclude.values {
-		if strings.Contains(value, include) {
+	for _, pattern := range patterns {
+		if matches(pattern, label, labelled, value) {
 			return true
 		}
 	}
 
 	return false
 }
+
+func matches(pattern, label string, labelled bool, value string) bool {
+	if name, ok := strings.CutPrefix(pattern, labelFilterPrefix); ok {
+		return labelled && label == name
+	}
+
+	return strings.Contains(value, pattern)
+}
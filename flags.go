@@ -2,19 +2,54 @@ package main
 
 import (
 	"flag"
+	"time"
 )
 
 var (
-	flagListen         = flag.String("l", "localhost:9223", "listen address")
-	flagRemote         = flag.String("r", "localhost:9222", "remote address")
-	flagEllipsis       = flag.Int("s", 0, "shorten requests and responses if above length")
-	flagOnce           = flag.Bool("once", false, "debug single session")
-	flagShowRequests   = flag.Bool("i", false, "include request frames as they are sent")
-	flagDistributeLogs = flag.Bool("d", false, "write logs file per targetId")
-	flagQuiet          = flag.Bool("q", false, "do not show logs on stdout")
-	flagMicroseconds   = flag.Bool("m", false, "display time in microseconds")
-	flagDelta          = flag.Bool("delta", false, "show delta time between log entries")
-	flagForceColor     = flag.Bool("force-color", false, "force color output regardless of TTY")
-	flagDirLogs        = flag.String("log-dir", "logs", "logs directory")
-	flagVersion        = flag.Bool("version", false, "display version information")
+	flagListen              = flag.String("l", "localhost:9223", "listen address (host:port or unix:<path>)")
+	flagRemote              = flag.String("r", "localhost:9222", "remote address (host:port, unix:<path> or http://, https://, ws:// or wss:// URL), comma separated for multiple remotes")
+	flagEllipsis            = flag.Int("s", 0, "shorten requests and responses if above length")
+	flagOnce                = flag.Bool("once", false, "debug single session")
+	flagShowRequests        = flag.Bool("i", false, "include request frames as they are sent")
+	flagDistributeLogs      = flag.Bool("d", false, "write logs file per targetId")
+	flagQuiet               = flag.Bool("q", false, "do not show logs on stdout")
+	flagMicroseconds        = flag.Bool("m", false, "display time in microseconds")
+	flagDelta               = flag.Bool("delta", false, "show delta time between log entries")
+	flagForceColor          = flag.Bool("force-color", false, "force color output regardless of TTY")
+	flagDirLogs             = flag.String("log-dir", "logs", "logs directory")
+	flagVersion             = flag.Bool("version", false, "display version information")
+	flagConsole             = flag.Bool("console", false, "display console messages and exceptions as readable lines instead of raw events")
+	flagConsoleFile         = flag.Bool("console-file", false, "write console messages and exceptions to log file per targetId")
+	flagArtifacts           = flag.Bool("artifacts", false, "write screenshots, PDFs and screencast frames to logs directory instead of logging their payload")
+	flagScreencastGIF       = flag.Bool("screencast-gif", false, "assemble screencast frames into animated GIF per targetId (implies -artifacts)")
+	flagTraces              = flag.Bool("traces", false, "write traces, CPU profiles and heap snapshots per targetId to logs directory")
+	flagNoDefaultRedactions = flag.Bool("no-default-redactions", false, "do not redact cookies, authorization headers and typed text by default")
+	flagFaultSeed           = flag.Int64("fault-seed", 0, "seed of injected faults (random if 0)")
+	flagPolicy              = flag.String("policy", "", "JSON file with policy of allowed and denied commands")
+	flagTLSCert             = flag.String("tls-cert", "", "serve HTTPS and WSS with certificate from given PEM file")
+	flagTLSKey              = flag.String("tls-key", "", "private key of -tls-cert certificate")
+	flagTLSSelfSigned       = flag.Bool("tls-self-signed", false, "serve HTTPS and WSS with generated self-signed certificate")
+	flagRemoteCA            = flag.String("remote-ca", "", "PEM file with CA certificates trusted when connecting to remote over TLS")
+	flagRemoteCert          = flag.String("remote-cert", "", "client certificate presented when connecting to remote over TLS")
+	flagRemoteKey           = flag.String("remote-key", "", "private key of -remote-cert certificate")
+	flagRemoteServerName    = flag.String("remote-server-name", "", "server name (SNI) used when connecting to remote over TLS")
+	flagRemoteInsecure      = flag.Bool("remote-insecure", false, "do not verify certificate of remote")
+	flagLaunch              = flag.String("launch", "", "launch browser with given command line, restart it when it exits and stop it on shutdown")
+	flagPipe                = flag.String("pipe", "", "talk with browser over --remote-debugging-pipe: browser command line to launch (as with -launch) or fd:<write fd>,<read fd> of inherited pipe")
+	flagRemotesFile         = flag.String("remotes-file", "", "file with remote addresses, one per line, reloaded on every health check")
+	flagRoute               = flag.String("route", "round-robin", "routing of new browser connections among remotes: round-robin, least-connections or sticky (by cpp-route query parameter or X-CDP-Proxy-Route header, falling back to connection label)")
+	flagHealthInterval      = flag.Duration("health-interval", 10*time.Second, "interval of remote health checks")
+	flagQuota               = flag.String("quota", "", "limits of every connection: targets=<n>,rps=<n>,inflight=<n>,bytes=<n>[KB|MB|GB]")
+	flagIdentityQuota       = flag.String("identity-quota", "", "limits of all connections of authenticated identity (or client address) in -quota format")
+	flagCleanup             = flag.Bool("cleanup", false, "close targets and browser contexts created by the client when it disconnects")
+	flagResumeGrace         = flag.Duration("resume-grace", 0, "keep browser connection open for given time after the client disconnects so that it can resume with its token (disabled if 0)")
+	flagShutdownTimeout     = flag.Duration("shutdown-timeout", 10*time.Second, "time given to connections to close and logs to be written on shutdown")
+	flagKeepalive           = flag.Duration("keepalive", 0, "ping client and browser with given interval instead of relaying their pings, disconnecting client which does not answer (disabled if 0)")
+	flagIdleTimeout         = flag.Duration("idle-timeout", 0, "close connection with no frames in either direction for given time (disabled if 0)")
+	flagMaxDuration         = flag.Duration("max-duration", 0, "close connection lasting longer than given time (disabled if 0)")
+	flagCommandTimeout      = flag.Duration("command-timeout", 0, "close connection when command is not answered by the browser within given time (disabled if 0)")
+	flagFlightRecorder      = flag.String("flight-recorder", "", "keep latest frames of every connection in memory and write them to logs directory only on errors, exceptions, abnormal close or trigger: frames=<n>,bytes=<n>[KB|MB|GB],pending=<duration>,interval=<duration>")
+	flagLogRotate           = flag.String("log-rotate", "", "rotate log files when they reach given size or age, optionally compressing rotated ones: size=<n>[KB|MB|GB],interval=<duration>,compress=gzip|zstd")
+	flagLogRetention        = flag.String("log-retention", "", "delete log files older than given age or the oldest ones when all of them take more than given size: age=<duration>,size=<n>[KB|MB|GB]")
+	flagWaterfall           = flag.Bool("waterfall", false, "display network waterfall per target when it is detached or connection is closed")
 )
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	indexFileName = "index.json"
+	// maxIndexedConnections bounds the index, the oldest finished connections are dropped first.
+	maxIndexedConnections = 1000
+)
+
+// indexedSession describes session of the connection and target it was attached to.
+type indexedSession struct {
+	SessionID       string `json:"sessionId"`
+	ParentSessionID string `json:"parentSessionId,omitempty"`
+	TargetID        string `json:"targetId,omitempty"`
+	Type            string `json:"type,omitempty"`
+	URL             string `json:"url,omitempty"`
+	Title           string `json:"title,omitempty"`
+}
+
+// indexedConnection describes connection and all files written for it.
+type indexedConnection struct {
+	ID              string           `json:"id"`
+	Label           string           `json:"label,omitempty"`
+	RemoteAddr      string           `json:"remoteAddr"`
+	Identity        string           `json:"identity,omitempty"`
+	Path            string           `json:"path"`
+	Browser         string           `json:"browser,omitempty"`
+	ProtocolVersion string           `json:"protocolVersion,omitempty"`
+	Started         time.Time        `json:"started"`
+	Ended           *time.Time       `json:"ended,omitempty"`
+	Interrupted     bool             `json:"interrupted,omitempty"`
+	Frames          int64            `json:"frames"`
+	Errors          int64            `json:"errors"`
+	Sessions        []indexedSession `json:"sessions"`
+	Files           []string         `json:"files"`
+}
+
+var index = struct {
+	sync.Mutex
+	loaded      bool
+	connections []*indexedConnection
+	entries     map[*connection]*indexedConnection
+}{entries: make(map[*connection]*indexedConnection)}
+
+// indexEnabled reports whether proxy writes any files for connections which should be indexed.
+func indexEnabled() bool {
+	return *flagDistributeLogs || artifactsEnabled() || *flagTraces || *flagConsoleFile || flightRecorder != nil
+}
+
+// updateIndex refreshes entry of the connection and rewrites index.json in logs directory.
+// Connections listed by index of previous runs are kept as long as any of their files exist.
+func updateIndex(conn *connection, ended bool) error {
+	index.Lock()
+	defer index.Unlock()
+
+	if !index.loaded {
+		index.loaded = true
+
+		if err := loadIndex(); err != nil {
+			conn.logger.Errorf("could not read previous %s: %v", indexFileName, err)
+		}
+	}
+
+	entry, exists := index.entries[conn]
+	if !exists {
+		entry = &indexedConnection{}
+		index.entries[conn] = entry
+		index.connections = append(index.connections, entry)
+	}
+
+	conn.indexed(entry)
+
+	if ended {
+		now := time.Now()
+		entry.Ended = &now
+		delete(index.entries, conn)
+	}
+
+	pruneIndex()
+
+	return writeIndex()
+}
+
+// writeIndex replaces index.json with current index, index lock has to be held.
+func writeIndex() error {
+	data, err := json.MarshalIndent(struct {
+		Updated     time.Time            `json:"updated"`
+		Connections []*indexedConnection `json:"connections"`
+	}{time.Now(), index.connections}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*flagDirLogs, os.ModePerm); err != nil {
+		return err
+	}
+
+	// index is replaced at once so that it is never read half-written
+	path := filepath.Join(*flagDirLogs, indexFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func loadIndex() error {
+	data, err := os.ReadFile(filepath.Join(*flagDirLogs, indexFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var previous struct {
+		Connections []*indexedConnection `json:"connections"`
+	}
+
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return err
+	}
+
+	var connections []*indexedConnection
+
+	for _, entry := range previous.Connections {
+		// connection which never ended was cut off by crashed or killed proxy
+		if entry.Ended == nil {
+			entry.Interrupted = true
+		}
+
+		var files []string
+		for _, path := range entry.Files {
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			}
+		}
+
+		if len(files) > 0 {
+			entry.Files = files
+			connections = append(connections, entry)
+		}
+	}
+
+	index.connections = append(connections, index.connections...)
+
+	return nil
+}
+
+// pruneIndex drops the oldest finished connections above maxIndexedConnections, index lock has to be held.
+func pruneIndex() {
+	excess := len(index.connections) - maxIndexedConnections
+	if excess <= 0 {
+		return
+	}
+
+	connections := make([]*indexedConnection, 0, maxIndexedConnections)
+
+	for _, entry := range index.connections {
+		if excess > 0 && (entry.Ended != nil || entry.Interrupted) {
+			excess--
+			continue
+		}
+
+		connections = append(connections, entry)
+	}
+
+	index.connections = connections
+}
+
+// forgetIndexedFiles removes deleted files from the index along with finished connections left without any files.
+func forgetIndexedFiles(deleted []string) error {
+	index.Lock()
+	defer index.Unlock()
+
+	if !index.loaded {
+		// stale entries are dropped when index is loaded
+		return nil
+	}
+
+	gone := make(map[string]bool, len(deleted))
+	for _, path := range deleted {
+		gone[filepath.Clean(path)] = true
+	}
+
+	changed := false
+	connections := index.connections[:0]
+
+	for _, entry := range index.connections {
+		files := entry.Files[:0]
+		for _, path := range entry.Files {
+			if !gone[filepath.Clean(path)] {
+				files = append(files, path)
+			}
+		}
+
+		if len(files) != len(entry.Files) {
+			changed = true
+			entry.Files = files
+
+			if len(files) == 0 && (entry.Ended != nil || entry.Interrupted) {
+				continue
+			}
+		}
+
+		connections = append(connections, entry)
+	}
+
+	index.connections = connections
+
+	if !changed {
+		return nil
+	}
+
+	return writeIndex()
+}
+
+// indexFileCopy lists copy of the file (rotated or compressed log) along with it for every connection which wrote it,
+// replacing the file if it no longer exists.
+func indexFileCopy(path, copy string, replace bool) error {
+	index.Lock()
+	defer index.Unlock()
+
+	for conn := range index.entries {
+		conn.copied(path, copy, replace)
+	}
+
+	changed := false
+
+	for _, entry := range index.connections {
+		if files, listed := copiedFiles(entry.Files, path, copy, replace); listed {
+			entry.Files, changed = files, true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return writeIndex()
+}
+
+// copiedFiles appends copy to files or replaces path with it, reporting whether files listed path.
+func copiedFiles(files []string, path, copy string, replace bool) ([]string, bool) {
+	for i, file := range files {
+		if file != path {
+			continue
+		}
+
+		if replace {
+			files[i] = copy
+			return files, true
+		}
+
+		return append(files, copy), true
+	}
+
+	return files, false
+}
+
+// indexed fills entry with current state of the connection.
+func (c *connection) indexed(entry *indexedConnection) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry.ID = c.id
+	entry.Label = c.label
+	entry.RemoteAddr = c.remoteAddr
+	entry.Identity = c.identity
+	entry.Path = c.path
+	entry.Browser = c.version["Browser"]
+	entry.ProtocolVersion = c.version["Protocol-Version"]
+	entry.Started = c.started
+	entry.Frames = c.messages.Load()
+	entry.Errors = c.errors.Load()
+	entry.Sessions = c.registry.indexed()
+	entry.Files = append([]string{}, c.files...)
+}
+
+// wrote records path of the file written for the connection so that it is listed in the index.
+func (c *connection) wrote(path string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.written[path] {
+		return
+	}
+
+	c.written[path] = true
+	c.files = append(c.files, path)
+}
+
+// copied records copy of the file written for the connection, see indexFileCopy.
+func (c *connection) copied(path, copy string, replace bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.written[path] || c.written[copy] {
+		return
+	}
+
+	c.files, _ = copiedFiles(c.files, path, copy, replace)
+	c.written[copy] = true
+
+	if replace {
+		delete(c.written, path)
+	}
+}
+
+// indexed describes all known sessions in order they were attached.
+func (r *targetRegistry) indexed() []indexedSession {
+	r.Lock()
+	defer r.Unlock()
+
+	sessions := []indexedSession{}
+
+	for _, sessionID := range r.order {
+		session := indexedSession{SessionID: sessionID, ParentSessionID: r.parents[sessionID], TargetID: r.sessions[sessionID]}
+
+		if target, exists := r.targets[session.TargetID]; exists {
+			session.Type, session.URL, session.Title = target.Type, target.URL, target.Title
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetIndex points index to a temporary logs directory.
+func resetIndex(t *testing.T) string {
+	dir := *flagDirLogs
+	*flagDirLogs = t.TempDir()
+
+	t.Cleanup(func() {
+		*flagDirLogs = dir
+		index.loaded, index.connections, index.entries = false, nil, make(map[*connection]*indexedConnection)
+	})
+
+	return *flagDirLogs
+}
+
+func TestIndexLoadDropsMissingFilesAndMarksInterrupted(t *testing.T) {
+	ended := time.Now()
+	dir := resetIndex(t)
+
+	kept, gone := filepath.Join(dir, "kept.log"), filepath.Join(dir, "gone.log")
+	if err := os.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"connections": []*indexedConnection{
+		{ID: "ended", Ended: &ended, Files: []string{gone}},
+		{ID: "crashed", Files: []string{kept, gone}},
+	}})
+	if err := os.WriteFile(filepath.Join(dir, indexFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index.Lock()
+	defer index.Unlock()
+
+	if err := loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.connections) != 1 {
+		t.Fatalf("expected connection without files to be dropped, got %d", len(index.connections))
+	}
+
+	entry := index.connections[0]
+	if entry.ID != "crashed" || !entry.Interrupted || len(entry.Files) != 1 || entry.Files[0] != kept {
+		t.Fatalf("expected interrupted connection with existing files only, got %+v", entry)
+	}
+}
+
+func TestIndexPrunedToLimit(t *testing.T) {
+	resetIndex(t)
+
+	ended := time.Now()
+	active := &indexedConnection{ID: "active"}
+	index.connections = []*indexedConnection{active}
+
+	for i := 0; i < maxIndexedConnections+10; i++ {
+		index.connections = append(index.connections, &indexedConnection{ID: "ended", Ended: &ended})
+	}
+
+	pruneIndex()
+
+	if len(index.connections) != maxIndexedConnections || index.connections[0] != active {
+		t.Fatalf("expected index pruned to %d with active connection kept, got %d", maxIndexedConnections, len(index.connections))
+	}
+}
+
+func TestForgetIndexedFiles(t *testing.T) {
+	dir := resetIndex(t)
+
+	ended := time.Now()
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+
+	index.loaded = true
+	index.connections = []*indexedConnection{
+		{ID: "first", Ended: &ended, Files: []string{first}},
+		{ID: "second", Ended: &ended, Files: []string{first, second}},
+	}
+
+	if err := forgetIndexedFiles([]string{first}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.connections) != 1 || index.connections[0].ID != "second" || len(index.connections[0].Files) != 1 {
+		t.Fatalf("expected only connection with remaining files to be kept, got %+v", index.connections)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written struct {
+		Connections []*indexedConnection `json:"connections"`
+	}
+	if err := json.Unmarshal(data, &written); err != nil || len(written.Connections) != 1 {
+		t.Fatalf("expected index to be rewritten, got %s", data)
+	}
+}
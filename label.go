@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	labelQueryParam   = "cpp-label"
+	labelHeader       = "X-CDP-Proxy-Label"
+	labelFilterPrefix = "label:"
+	labelMaxLength    = 64
+)
+
+// labelFrom returns label given by the client, reduced to characters which are safe in file names.
+func labelFrom(req *http.Request) string {
+	label := req.URL.Query().Get(labelQueryParam)
+	if label == "" {
+		label = req.Header.Get(labelHeader)
+	}
+
+	label = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+
+		return '_'
+	}, strings.TrimSpace(label))
+
+	if len(label) > labelMaxLength {
+		label = label[:labelMaxLength]
+	}
+
+	return strings.Trim(label, ".")
+}
+
+// column returns what is displayed in the target column for messages of given session, prefixed with label of the connection.
+func (c *connection) column(sessionID string) string {
+	if sessionID == "" {
+		if c.label != "" {
+			return center(c.label, 32)
+		}
+
+		return protocolTargetID
+	}
+
+	if c.label != "" {
+		return c.label + " " + c.registry.path(sessionID)
+	}
+
+	return c.registry.path(sessionID)
+}
+
+// logName returns name of the log file of the connection, prefixed with its label.
+func (c *connection) logName(name string) string {
+	if c.label == "" {
+		return name
+	}
+
+	return c.label + "-" + name
+}
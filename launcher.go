@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	portFlag            = "--remote-debugging-port"
+	launchReadyTimeout  = 30 * time.Second
+	launchPollInterval  = 100 * time.Millisecond
+	launchStopTimeout   = 5 * time.Second
+	launchStableRuntime = time.Minute
+)
+
+// backoff between restarts of the browser, variables so that tests don't have to wait for seconds
+var (
+	launchMinBackoff = time.Second
+	launchMaxBackoff = 30 * time.Second
+)
+
+var errBrowserStopped = errors.New("browser was stopped")
+
+// browserProcess supervises browser launched by the proxy, restarting it with backoff when it exits.
+type browserProcess struct {
+	sync.Mutex
+	name    string
+	args    []string
+	remote  *upstream
+	pipe    *pipeBrowser
+	logger  *logrus.Entry
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	stopped bool
+	// stopping is closed when the browser is stopped and supervised when its supervisor exits
+	stopping   chan struct{}
+	supervised chan struct{}
+}
+
+// launchBrowser starts browser with given command line and waits until it is ready to accept connections.
+// Browser is reached over pipe if pipe is given (or --remote-debugging-pipe is passed) and on remote port otherwise.
+func launchBrowser(commandLine string, remote *upstream, pipe *pipeBrowser, logger *logrus.Entry) (*browserProcess, error) {
+	args, err := splitCommandLine(commandLine)
+	if err != nil {
+		return nil, fmt.Errorf("invalid browser command: %v", err)
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid browser command: empty command")
+	}
+
+	p := &browserProcess{
+		name:       args[0],
+		args:       args[1:],
+		remote:     remote,
+		pipe:       pipe,
+		logger:     logger,
+		stopping:   make(chan struct{}),
+		supervised: make(chan struct{}),
+	}
+
+	if pipe == nil && !hasArgument(p.args, pipeFlag) {
+		port, err := remote.port()
+		if err != nil {
+			return nil, fmt.Errorf("could not launch browser: %v", err)
+		}
+
+		if !hasArgument(p.args, portFlag) {
+			p.args = append(p.args, portFlag+"="+port)
+		}
+	}
+
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+
+	go p.supervise()
+
+	return p, nil
+}
+
+// start launches the browser and waits until it responds to version query.
+func (p *browserProcess) start() error {
+	if p.isStopped() {
+		return errBrowserStopped
+	}
+
+	var cmd *exec.Cmd
+	var writer, reader *os.File
+
+	if p.pipe != nil {
+		var err error
+		if cmd, writer, reader, err = pipeCommand(p.name, p.args...); err != nil {
+			return err
+		}
+	} else {
+		cmd = exec.Command(p.name, p.args...)
+	}
+
+	output, outputWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+
+	p.logger.Infof("launching browser: %s", strings.Join(cmd.Args, " "))
+
+	err = cmd.Start()
+	for _, file := range append(cmd.ExtraFiles, outputWriter) {
+		file.Close()
+	}
+
+	if err != nil {
+		output.Close()
+		return fmt.Errorf("could not launch browser %s: %v", p.name, err)
+	}
+
+	exited := make(chan struct{})
+	go p.forward(output)
+	go p.wait(cmd, exited)
+
+	// browser stopped while this one was being launched would be left running
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		_ = cmd.Process.Kill()
+		<-exited
+		return errBrowserStopped
+	}
+
+	p.cmd = cmd
+	p.exited = exited
+	p.Unlock()
+
+	if err := p.waitReady(writer, reader, exited); err != nil {
+		p.kill()
+		return fmt.Errorf("browser %s is not ready: %v", p.name, err)
+	}
+
+	p.logger.Infof("browser is ready (pid %d)", cmd.Process.Pid)
+
+	return nil
+}
+
+// forward logs output of the browser (and its child processes) line by line.
+func (p *browserProcess) forward(output io.ReadCloser) {
+	defer output.Close()
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		p.logger.Infof("browser: %s", scanner.Text())
+	}
+}
+
+func (p *browserProcess) wait(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	if err != nil {
+		p.logger.Errorf("browser exited: %v", err)
+	} else {
+		p.logger.Infof("browser exited")
+	}
+
+	close(exited)
+}
+
+func (p *browserProcess) waitReady(writer, reader *os.File, exited chan struct{}) error {
+	if p.pipe != nil {
+		ready := make(chan error, 1)
+		go func() {
+			ready <- p.pipe.attach(writer, reader)
+		}()
+
+		select {
+		case err := <-ready:
+			return err
+		case <-time.After(launchReadyTimeout):
+			writer.Close()
+			reader.Close()
+			return fmt.Errorf("timeout after %s", launchReadyTimeout)
+		}
+	}
+
+	deadline := time.Now().Add(launchReadyTimeout)
+	for {
+		_, err := checkVersion(p.remote)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %s: %v", launchReadyTimeout, err)
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("browser exited")
+		case <-time.After(launchPollInterval):
+		}
+	}
+}
+
+// supervise restarts the browser whenever it exits until it is stopped.
+func (p *browserProcess) supervise() {
+	defer close(p.supervised)
+
+	backoff := launchMinBackoff
+
+	for {
+		p.Lock()
+		exited := p.exited
+		started := time.Now()
+		p.Unlock()
+
+		<-exited
+
+		if time.Since(started) > launchStableRuntime {
+			backoff = launchMinBackoff
+		}
+
+		for {
+			if p.isStopped() {
+				return
+			}
+
+			p.logger.Errorf("restarting browser in %s", backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-p.stopping:
+				return
+			}
+
+			if backoff *= 2; backoff > launchMaxBackoff {
+				backoff = launchMaxBackoff
+			}
+
+			if p.isStopped() {
+				return
+			}
+
+			if err := p.start(); err != nil {
+				p.logger.Errorf("could not restart browser: %v", err)
+				continue
+			}
+
+			break
+		}
+	}
+}
+
+func (p *browserProcess) isStopped() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.stopped
+}
+
+// stop terminates the browser, killing it if it does not exit in time, prevents it from being restarted
+// and waits until its supervisor exits.
+func (p *browserProcess) stop() {
+	p.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stopping)
+	}
+	cmd, exited := p.cmd, p.exited
+	p.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		p.logger.Infof("stopping browser (pid %d)", cmd.Process.Pid)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+
+		select {
+		case <-exited:
+		case <-time.After(launchStopTimeout):
+			p.kill()
+			<-exited
+		}
+	}
+
+	<-p.supervised
+
+	if p.pipe != nil {
+		p.pipe.close()
+	}
+}
+
+func (p *browserProcess) kill() {
+	p.Lock()
+	cmd := p.cmd
+	p.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+// splitCommandLine splits command line into arguments like shell does, honouring single and double quotes
+// and backslash escapes, i.e. --user-data-dir="/tmp/a b" is a single argument.
+func splitCommandLine(commandLine string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArgument, escaped := false, false
+
+	for _, r := range commandLine {
+		switch {
+		case escaped:
+			// within double quotes backslash escapes only characters which are special there
+			if quote == '"' && !strings.ContainsRune(`"\$`+"`", r) {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+
+		case r == '\\' && quote != '\'':
+			escaped, inArgument = true, true
+
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+
+		case r == '\'' || r == '"':
+			quote, inArgument = r, true
+
+		case unicode.IsSpace(r):
+			if inArgument {
+				args = append(args, current.String())
+				current.Reset()
+				inArgument = false
+			}
+
+		default:
+			current.WriteRune(r)
+			inArgument = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	if escaped {
+		return nil, errors.New("command line ends with backslash")
+	}
+
+	if inArgument {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// hasArgument reports whether flag (with or without value) is present in args.
+func hasArgument(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// port returns port of the upstream, which browser launched by the proxy should listen on.
+func (u *upstream) port() (string, error) {
+	if u.socket != "" {
+		return "", fmt.Errorf("browser can't listen on unix socket %s", u.socket)
+	}
+
+	_, port, err := net.SplitHostPort(u.host)
+	if err != nil {
+		return "", fmt.Errorf("remote address %s has no port: %v", u.host, err)
+	}
+
+	return port, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// launcherBrowserHelper serves /json/version on --remote-debugging-port, records its start
+// to CPP_TEST_LAUNCH_LOG and exits after CPP_TEST_LAUNCH_LIFETIME, if it's positive.
+func launcherBrowserHelper() {
+	var port string
+	for _, arg := range os.Args[1:] {
+		if value, ok := strings.CutPrefix(arg, portFlag+"="); ok {
+			port = value
+		}
+	}
+
+	if log, err := os.OpenFile(os.Getenv("CPP_TEST_LAUNCH_LOG"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		fmt.Fprintf(log, "%d %d %s\n", os.Getpid(), time.Now().UnixNano(), strings.Join(os.Args[1:], "|"))
+		log.Close()
+	}
+
+	go http.ListenAndServe("localhost:"+port, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"Browser":"Helper/1.0","Protocol-Version":"1.3"}`))
+	}))
+
+	if lifetime, err := time.ParseDuration(os.Getenv("CPP_TEST_LAUNCH_LIFETIME")); err == nil && lifetime > 0 {
+		time.Sleep(lifetime)
+		os.Exit(1)
+	}
+
+	select {}
+}
+
+type launch struct {
+	pid  int
+	time time.Time
+	args []string
+}
+
+func launches(t *testing.T, path string) []launch {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	var result []launch
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var pid int
+		var nanos int64
+		var args string
+
+		if _, err := fmt.Sscanf(line, "%d %d %s", &pid, &nanos, &args); err == nil {
+			// args are separated by | as they may contain spaces
+			result = append(result, launch{pid: pid, time: time.Unix(0, nanos), args: strings.Split(line[strings.Index(line, args):], "|")})
+		}
+	}
+
+	return result
+}
+
+func startHelperBrowser(t *testing.T, lifetime time.Duration) (*browserProcess, string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	remote, err := parseUpstream(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(t.TempDir(), "launches")
+	t.Setenv(helperEnv, "launcher-browser")
+	t.Setenv("CPP_TEST_LAUNCH_LOG", log)
+	t.Setenv("CPP_TEST_LAUNCH_LIFETIME", lifetime.String())
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	browser, err := launchBrowser(os.Args[0]+` -test.run=^$ --user-data-dir="/tmp/a b" --flag='x y'`, remote, nil, logrus.NewEntry(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return browser, log
+}
+
+func TestLaunchRestartsWithBackoff(t *testing.T) {
+	launchMinBackoff, launchMaxBackoff = 100*time.Millisecond, 400*time.Millisecond
+	defer func() { launchMinBackoff, launchMaxBackoff = time.Second, 30*time.Second }()
+
+	browser, log := startHelperBrowser(t, 300*time.Millisecond)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(launches(t, log)) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("browser was not restarted, launches: %+v", launches(t, log))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	browser.stop()
+	stopped := launches(t, log)
+
+	// every restart waits twice as long as the previous one
+	for i := 2; i < 4; i++ {
+		previous, current := stopped[i-1].time.Sub(stopped[i-2].time), stopped[i].time.Sub(stopped[i-1].time)
+		if current < previous+50*time.Millisecond {
+			t.Errorf("expected growing backoff, restart %d after %s, restart %d after %s", i-1, previous, i, current)
+		}
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if after := launches(t, log); len(after) != len(stopped) {
+		t.Fatalf("browser was restarted after it was stopped: %+v", after[len(stopped):])
+	}
+}
+
+func TestLaunchStop(t *testing.T) {
+	browser, log := startHelperBrowser(t, 0)
+
+	started := launches(t, log)
+	if len(started) != 1 {
+		t.Fatalf("expected single launch, got %+v", started)
+	}
+
+	expected := []string{"-test.run=^$", "--user-data-dir=/tmp/a b", "--flag=x y", portFlag + "=" + browser.remote.host[strings.LastIndex(browser.remote.host, ":")+1:]}
+	if !reflect.DeepEqual(started[0].args, expected) {
+		t.Errorf("expected quoted arguments %q, got %q", expected, started[0].args)
+	}
+
+	browser.stop()
+
+	if err := syscall.Kill(started[0].pid, 0); err != syscall.ESRCH {
+		t.Errorf("expected browser process %d to be gone, got %v", started[0].pid, err)
+	}
+
+	if after := launches(t, log); len(after) != 1 {
+		t.Fatalf("browser was restarted after it was stopped: %+v", after)
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := map[string][]string{
+		`chromium --headless  --no-sandbox`:       {"chromium", "--headless", "--no-sandbox"},
+		`chromium --user-data-dir="/tmp/a b"`:     {"chromium", "--user-data-dir=/tmp/a b"},
+		`"/opt/my chrome/chrome" 'a "b"' c\ d ""`: {"/opt/my chrome/chrome", `a "b"`, "c d", ""},
+		`chromium "a \"b\" \x"`:                   {"chromium", `a "b" \x`},
+	}
+
+	for commandLine, expected := range cases {
+		args, err := splitCommandLine(commandLine)
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Errorf("splitCommandLine(%s) = %q, %v, expected %q", commandLine, args, err, expected)
+		}
+	}
+
+	for _, commandLine := range []string{`chromium "a`, `chromium 'a`, `chromium \`} {
+		if _, err := splitCommandLine(commandLine); err == nil {
+			t.Errorf("expected error splitting %s", commandLine)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	unixPrefix         = "unix:"
+)
+
+// listen opens listening socket on -l address (host:port or unix:<path>), terminating TLS if it is configured.
+func listen() (net.Listener, error) {
+	network, address := "tcp", *flagListen
+
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		network, address = "unix", path
+
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := serverTLSConfig()
+	if err != nil || config == nil {
+		return listener, err
+	}
+
+	return tls.NewListener(listener, config), nil
+}
+
+// removeStaleSocket removes socket left by previous process so that it can be listened on again.
+// Socket which is still listened on by another process is kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("could not listen on %s: file exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("could not listen on %s: socket is in use by another process", path)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("could not listen on %s: could not check whether socket is in use: %v", path, err)
+	}
+
+	return os.Remove(path)
+}
+
+// listenURL returns address proxy is reachable on for logging purposes.
+func listenURL() string {
+	if strings.HasPrefix(*flagListen, unixPrefix) {
+		return *flagListen
+	}
+
+	return listenScheme() + "://" + *flagListen
+}
+
+// listenScheme returns scheme of the URLs proxy is reachable on.
+func listenScheme() string {
+	if *flagTLSCert != "" || *flagTLSSelfSigned {
+		return "https"
+	}
+
+	return "http"
+}
+
+// serverTLSConfig loads -tls-cert and -tls-key or generates self-signed certificate,
+// returning nil if TLS is not enabled.
+func serverTLSConfig() (*tls.Config, error) {
+	if *flagTLSCert != "" || *flagTLSKey != "" {
+		certificate, err := tls.LoadX509KeyPair(*flagTLSCert, *flagTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS certificate: %v", err)
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+	}
+
+	if *flagTLSSelfSigned {
+		certificate, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate self-signed certificate: %v", err)
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+	}
+
+	return nil, nil
+}
+
+// selfSignedCertificate generates certificate valid for localhost and listen address
+// and writes it to logs directory so that clients can trust it.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"chrome-protocol-proxy"}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if host, _, err := net.SplitHostPort(*flagListen); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.MkdirAll(*flagDirLogs, 0755); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPath := filepath.Join(*flagDirLogs, "self-signed.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	log.Printf("Generated self-signed certificate %s (SHA-256 fingerprint %X)", certPath, sha256.Sum256(der))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
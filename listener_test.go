@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("expected socket which is listened on to be kept")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected live socket to exist: %v", err)
+	}
+
+	// socket file is left behind as if the process was killed
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("expected stale socket to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected stale socket to be removed, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -18,6 +19,7 @@ const (
 	typeRequestResponse      = 1 << iota
 	typeRequestResponseError = 1 << iota
 	typeEvent                = 1 << iota
+	typeConsole              = 1 << iota
 )
 
 const (
@@ -33,12 +35,14 @@ const (
 	fieldRequest     = "request"
 	fieldMethod      = "method"
 	fieldInspectorID = "inspectorId"
+	fieldLabel       = "label"
 )
 
 const (
 	requestReplyFormat = "%-17s %-32s % 48s %s => %s\n"
 	requestFormat      = "%-17s %-32s % 48s %s\n"
 	eventFormat        = "%-17s %-32s % 48s %s\n"
+	consoleFormat      = "%-17s %-32s % 48s %s\n"
 	protocolFormat     = "%-17s %-32s\n"
 	timeFormat         = "15:04:05.00000000"
 	deltaFormat        = "Δ%8.2fms"
@@ -55,6 +59,8 @@ var (
 	targetColor       = color.New(color.FgHiWhite).SprintfFunc()
 	methodColor       = color.New(color.FgHiYellow).SprintfFunc()
 	errorColor        = color.New(color.BgRed, color.FgWhite).SprintfFunc()
+	consoleColor      = color.New(color.FgHiMagenta).SprintfFunc()
+	consoleErrorColor = color.New(color.FgHiRed).SprintfFunc()
 	protocolTargetID  = center("browser", 32)
 )
 
@@ -98,7 +104,9 @@ func (f *FramesFormatter) Format(e *logrus.Entry) ([]byte, error) {
 		protocolMethod = val
 	}
 
-	if !accept(protocolMethod, message) {
+	label, labelled := e.Data[fieldLabel].(string)
+
+	if !accept(label, labelled, protocolMethod, message) {
 		return []byte{}, nil
 	}
 
@@ -126,6 +134,13 @@ func (f *FramesFormatter) Format(e *logrus.Entry) ([]byte, error) {
 
 		case typeRequestResponseError:
 			return []byte(fmt.Sprintf(requestReplyFormat, timestamp, targetColor(targetID), methodColor(protocolMethod), requestReplyColor(e.Data[fieldRequest].(string)), errorColor(message))), nil
+
+		case typeConsole:
+			if e.Level == logrus.ErrorLevel {
+				return []byte(fmt.Sprintf(consoleFormat, timestamp, targetColor(targetID), eventsLabelColor(protocolMethod), consoleErrorColor(message))), nil
+			}
+
+			return []byte(fmt.Sprintf(consoleFormat, timestamp, targetColor(targetID), eventsLabelColor(protocolMethod), consoleColor(message))), nil
 		}
 	}
 
@@ -155,8 +170,9 @@ func (m *multiWriter) Close() (err error) {
 }
 
 var loggers = make(map[string]*logrus.Logger)
+var loggersLock sync.Mutex
 
-func createLogWriter(filename string) (io.Writer, error) {
+func createLogWriter(filename string, stdout bool) (io.Writer, error) {
 
 	if filename == "" {
 		if *flagQuiet {
@@ -166,7 +182,7 @@ func createLogWriter(filename string) (io.Writer, error) {
 		return os.Stdout, nil
 	}
 
-	logFilePath := fmt.Sprintf(*flagDirLogs+"/%s.log", filename)
+	logFilePath := logFilePath(filename)
 	dir := filepath.Dir(logFilePath)
 
 	if _, err := os.Stat(dir); err != nil {
@@ -175,25 +191,42 @@ func createLogWriter(filename string) (io.Writer, error) {
 		}
 	}
 
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	logFile, err := openRotatingFile(logFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	if *flagQuiet {
+	if *flagQuiet || !stdout {
 		return newMultiWriter(logFile), nil
 	}
 
 	return newMultiWriter(logFile, os.Stdout), nil
 }
 
+// logFilePath returns path of the log file with given name.
+func logFilePath(name string) string {
+	return fmt.Sprintf(*flagDirLogs+"/%s.log", name)
+}
+
 func createLogger(name string) (*logrus.Logger, error) {
+	return newLogger(name, true)
+}
+
+// createFileLogger creates logger writing only to its own file in logs directory.
+func createFileLogger(name string) (*logrus.Logger, error) {
+	return newLogger(name, false)
+}
+
+func newLogger(name string, stdout bool) (*logrus.Logger, error) {
 	if *flagForceColor {
 		color.NoColor = false
 	}
 
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+
 	if _, exists := loggers[name]; !exists {
-		writer, err := createLogWriter(name)
+		writer, err := createLogWriter(name, stdout)
 		if err != nil {
 			return nil, err
 		}
@@ -210,6 +243,9 @@ func createLogger(name string) (*logrus.Logger, error) {
 }
 
 func destroyLogger(name string) error {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+
 	if logger, exists := loggers[name]; exists {
 		if closer, ok := logger.Out.(io.Closer); ok {
 			closer.Close()
@@ -220,3 +256,17 @@ func destroyLogger(name string) error {
 
 	return nil
 }
+
+// closeLoggers closes files of all loggers on shutdown.
+func closeLoggers() {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+
+	for name, logger := range loggers {
+		if closer, ok := logger.Out.(io.Closer); ok {
+			closer.Close()
+		}
+
+		delete(loggers, name)
+	}
+}
@@ -9,8 +9,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"path"
 	"strconv"
@@ -18,6 +16,7 @@ import (
 
 	"errors"
 
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,19 +30,32 @@ var (
 func main() {
 	flag.Parse()
 
+	if err := parseRedactions(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadQuotas(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadFlightRecorder(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadLogRotation(); err != nil {
+		log.Fatal(err)
+	}
+
 	if *flagVersion {
 		fmt.Printf("%s version %s built on %s by %s\n\nConfiguration:\n", os.Args[0], version, date, builtBy)
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	mux := http.NewServeMux()
-
-	simpleReverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: *flagRemote})
-
-	mux.Handle("/json", simpleReverseProxy)
-	mux.Handle("/", simpleReverseProxy)
-
 	rootLogger, err := createLogger("connection")
 	if err != nil {
 		panic(fmt.Sprintf("could not create logger: %s", err))
@@ -53,12 +65,65 @@ func main() {
 		fieldLevel: levelConnection,
 	})
 
+	if logRetention != nil {
+		go watchRetention(logger)
+	}
+
+	pool, err := newUpstreamPool(logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// listening socket is opened before the browser is launched so that failing to listen doesn't leave it running
+	listener, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pipe, browser, err := setupBrowser(pool, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if pipe == nil {
+		pool.checkHealth()
+		go pool.watch(connectionsContext, *flagHealthInterval)
+	}
+
+	mux := http.NewServeMux()
+
+	var simpleReverseProxy http.Handler = pool
+	if pipe != nil {
+		simpleReverseProxy = pipe
+	}
+
+	mux.Handle("/json", simpleReverseProxy)
+	mux.Handle("/", simpleReverseProxy)
+
 	handlerFunc := func(basePath string) func(http.ResponseWriter, *http.Request) {
 		return func(res http.ResponseWriter, req *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+
+			if token := resumeToken(req); *flagResumeGrace > 0 && token != "" {
+				// tokens are generated by the proxy, so that connections can't be taken over by guessing them
+				if resumed := resumableConnection(token); resumed != nil {
+					resumeConnection(resumed, res, req)
+				} else {
+					logger.Errorf("could not resume connection from %s: unknown resume token", req.RemoteAddr)
+					http.Error(res, "unknown or expired resume token", http.StatusNotFound)
+				}
+
+				return
+			}
 
-			stream := make(chan *protocolMessage, 1024)
 			id := strings.ReplaceAll(strings.TrimPrefix(req.URL.Path, "/devtools/"), "/", "-")
 
+			label := labelFrom(req)
+			if label != "" {
+				id = label + "-" + id
+			}
+
 			var protocolLogger *logrus.Entry
 
 			if *flagDistributeLogs {
@@ -70,85 +135,222 @@ func main() {
 				protocolLogger = logger.WithFields(logrus.Fields{
 					fieldLevel:       levelConnection,
 					fieldInspectorID: id,
+					fieldLabel:       label,
 				})
 
 			} else {
 				protocolLogger = logger.WithFields(logrus.Fields{
 					fieldInspectorID: id,
+					fieldLabel:       label,
 				})
 			}
 
-			go dumpStream(protocolLogger, stream)
+			conn := newConnection(id, req.RemoteAddr, protocolLogger)
+			conn.identity = identityFrom(req)
+			conn.label = label
+			conn.path = req.URL.Path
 
-			endpoint := "ws://" + *flagRemote + "/devtools/" + basePath + "/" + path.Base(req.URL.Path)
+			if *flagDistributeLogs {
+				conn.wrote(logFilePath(id))
+			}
+			registerConnection(conn)
+			defer unregisterConnection(conn)
 
-			logger.Infof("---------- connection from %s to %s ----------", req.RemoteAddr, req.RequestURI)
-			logger.Infof("checking protocol versions on: %s", endpoint)
+			streams.Add(1)
+			go func() {
+				defer streams.Done()
+				dumpStream(conn)
 
-			ver, err := checkVersion()
-			if err != nil {
-				protocolLogger.Errorf("could not check version: %v", err)
-				http.Error(res, "could not check version", 500)
-				return
+				if indexEnabled() {
+					if err := updateIndex(conn, true); err != nil {
+						logger.Errorf("could not update %s: %v", indexFileName, err)
+					}
+				}
+
+				// logger of the connection is used until its stream is drained
+				if *flagDistributeLogs {
+					destroyLogger(id)
+				}
+			}()
+			defer conn.closeStream()
+
+			logger.Infof("---------- connection from %s to %s ----------", req.RemoteAddr, req.URL.Path)
+
+			if conn.identity != "" {
+				logger.Infof("authenticated as: %s", conn.identity)
 			}
 
-			logger.Infof("protocol version: %s", ver["Protocol-Version"])
-			logger.Infof("versions: Chrome(%s), V8(%s), Webkit(%s)", ver["Browser"], ver["V8-Version"], ver["WebKit-Version"])
-			logger.Infof("browser user agent: %s", ver["User-Agent"])
-			logger.Infof("connecting to %s... ", endpoint)
+			if conn.label != "" {
+				logger.Infof("label: %s", conn.label)
+			}
+
+			err := conn.setupInterceptors(req.URL.Query())
+			defer conn.quota.release()
 
-			// connecting to ws
-			out, pres, err := wsDialer.Dial(endpoint, nil)
 			if err != nil {
-				msg := fmt.Sprintf("could not connect to %s: %v", endpoint, err)
-				logger.Error(protocolError(msg))
-				http.Error(res, msg, 500)
+				protocolLogger.Errorf("could not configure connection: %v", err)
+				http.Error(res, err.Error(), http.StatusBadRequest)
 				return
 			}
-			defer pres.Body.Close()
+
+			var header http.Header
+			if *flagResumeGrace > 0 {
+				if err := registerResumable(conn); err != nil {
+					protocolLogger.Errorf("could not make connection resumable: %v", err)
+					http.Error(res, "could not make connection resumable", 500)
+					return
+				}
+				defer unregisterResumable(conn)
+
+				header = http.Header{resumeHeader: {conn.resumeToken}}
+			}
+
+			var out messageConn
+
+			if pipe != nil {
+				if basePath != "browser" {
+					logger.Errorf("could not connect to %s: only browser connection is available over pipe", req.URL.Path)
+					http.NotFound(res, req)
+					return
+				}
+
+				ver := pipe.browserVersion()
+				conn.version = ver
+				logger.Infof("protocol version: %s", ver["Protocol-Version"])
+				logger.Infof("versions: Chrome(%s), V8(%s), Webkit(%s)", ver["Browser"], ver["V8-Version"], ver["WebKit-Version"])
+				logger.Infof("connecting to browser pipe... ")
+
+				session, err := pipe.open()
+				if err != nil {
+					msg := fmt.Sprintf("could not connect to browser pipe: %v", err)
+					logger.Error(protocolError(msg))
+					http.Error(res, msg, http.StatusServiceUnavailable)
+					return
+				}
+
+				out = session
+			} else {
+				remote, release, err := pool.route(basePath, path.Base(req.URL.Path), routeKey(req))
+				if err != nil {
+					msg := fmt.Sprintf("could not route %s: %v", req.URL.Path, err)
+					logger.Error(protocolError(msg))
+					http.Error(res, msg, http.StatusBadGateway)
+					return
+				}
+				defer release()
+
+				endpoint := remote.wsURL(pool.devtoolsPath(remote, basePath, path.Base(req.URL.Path)))
+				logger.Infof("checking protocol versions on: %s", endpoint)
+
+				ver, err := checkVersion(remote)
+				if err != nil {
+					protocolLogger.Errorf("could not check version: %v", err)
+					http.Error(res, "could not check version", 500)
+					return
+				}
+
+				conn.version = ver
+
+				logger.Infof("protocol version: %s", ver["Protocol-Version"])
+				logger.Infof("versions: Chrome(%s), V8(%s), Webkit(%s)", ver["Browser"], ver["V8-Version"], ver["WebKit-Version"])
+				logger.Infof("browser user agent: %s", ver["User-Agent"])
+				logger.Infof("connecting to %s... ", endpoint)
+
+				// connecting to ws
+				ws, pres, err := remote.dialer().Dial(endpoint, nil)
+				if err != nil {
+					msg := fmt.Sprintf("could not connect to %s: %v", endpoint, err)
+					logger.Error(protocolError(msg))
+					http.Error(res, msg, 500)
+					return
+				}
+				defer pres.Body.Close()
+
+				out = ws
+			}
 			defer out.Close()
 
 			// connect incoming websocket
 			logger.Infof("upgrading connection on %s...", req.RemoteAddr)
-			in, err := wsUpgrader.Upgrade(res, req, nil)
+			in, err := wsUpgrader.Upgrade(res, req, header)
 			if err != nil {
 				logger.Errorf("could not upgrade websocket from %s: %v", req.RemoteAddr, err)
 				http.Error(res, "could not upgrade websocket connection", 500)
 				return
 			}
-			defer in.Close()
 
-			ctxt, cancel := context.WithCancel(context.Background())
+			if indexEnabled() {
+				if err := updateIndex(conn, false); err != nil {
+					logger.Errorf("could not update %s: %v", indexFileName, err)
+				}
+			}
+
+			conn.client = newWsWriter(in)
+			conn.client.resumable = *flagResumeGrace > 0
+			conn.browser = newWsWriter(out)
+			defer conn.client.Close()
+
+			ctxt, cancel := context.WithCancel(connectionsContext)
 			defer cancel()
 
-			errc := make(chan error, 1)
-			go proxyWS(ctxt, stream, in, out, errc)
-			go proxyWS(ctxt, stream, out, in, errc)
+			conn.watchClient(in)
+			conn.watchBrowser(out)
 
-			<-errc
-			close(stream)
+			if *flagKeepalive > 0 {
+				go conn.keepAlive(ctxt)
+			}
 
-			logger.Infof("---------- closing connection from %s to %s ----------", req.RemoteAddr, req.RequestURI)
+			if timeoutsEnabled() {
+				go conn.watchTimeouts(ctxt)
+			}
 
-			if *flagDistributeLogs {
-				destroyLogger(id)
+			if conn.recorder != nil {
+				go conn.recorder.watch(ctxt)
 			}
 
+			dir, err := conn.run(ctxt, in, out)
+
+			if err != nil {
+				conn.propagateClose(dir, err)
+			} else {
+				conn.client.closeWith(websocket.CloseGoingAway, shutdownCloseReason)
+				conn.browser.closeWith(websocket.CloseNormalClosure, "")
+			}
+
+			conn.closeStream()
+			recordConnection(conn)
+
+			logger.Infof("---------- closing connection from %s to %s ----------", req.RemoteAddr, req.URL.Path)
+
 			if *flagOnce {
-				os.Exit(0)
+				requestShutdown("-once")
 			}
 		}
 	}
 
 	mux.HandleFunc("/devtools/page/", handlerFunc("page"))
 	mux.HandleFunc("/devtools/browser/", handlerFunc("browser"))
+	mux.HandleFunc("/cpp/waterfall", waterfallHandler)
+	mux.HandleFunc("/cpp/flight-recorder", flightRecorderHandler)
 
-	log.Printf("Proxy is listening for DevTools connections on: %s", *flagListen)
+	go handleSignals()
 
-	log.Fatal(http.ListenAndServe(*flagListen, mux))
+	server := &http.Server{Handler: authenticate(logger, mux)}
+	go func() {
+		// launched browser is stopped by shutdown
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Errorf("could not serve: %v", err)
+			requestShutdown("server error")
+		}
+	}()
+
+	log.Printf("Proxy is listening for DevTools connections on: %s", listenURL())
+
+	shutdown(<-shutdownRequests, server, browser, logger)
 }
 
-func dumpStream(logger *logrus.Entry, stream chan *protocolMessage) {
+func dumpStream(conn *connection) {
+	logger := conn.logger
 	logger.Printf("Legend: %s, %s, %s, %s, %s, %s", protocolColor("protocol informations"),
 		eventsColor("received events"),
 		requestColor("sent request frames"),
@@ -157,221 +359,319 @@ func dumpStream(logger *logrus.Entry, stream chan *protocolMessage) {
 		errorColor("error response."),
 	)
 
-	requests := make(map[uint64]*protocolMessage)
-	sessions := make(map[string]map[uint64]*protocolMessage)
+	// with flight recorder frames are written to files only by its captures, so they are displayed on console only
+	frameLogger := logger
+	if conn.recorder != nil {
+		console, err := createLogger("")
+		if err != nil {
+			panic(fmt.Sprintf("could not create logger: %v", err))
+		}
+
+		frameLogger = console.WithFields(logger.Data)
+	}
+
+	requests := make(map[string]map[uint64]*protocolMessage)
+	registry := conn.registry
+	consoleLoggers := make(map[string]bool)
+	sessionLoggers := make(map[string]bool)
+
+	pendingRequests := func(sessionID string) map[uint64]*protocolMessage {
+		if _, exists := requests[sessionID]; !exists {
+			requests[sessionID] = make(map[uint64]*protocolMessage)
+		}
+
+		return requests[sessionID]
+	}
 
 loop:
 	for {
 		select {
-		case msg, ok := <-stream:
+		case msg, ok := <-conn.stream:
 			if !ok {
-				for sessionId := range sessions {
-					_ = destroyLogger(fmt.Sprintf("session-%s", sessionId))
+				if *flagWaterfall {
+					conn.logWaterfall(conn.waterfall.sessions()...)
+				}
+
+				conn.closeArtifacts(conn.artifacts.sessions()...)
+
+				if conn.recorder != nil && conn.abnormal != "" {
+					conn.recorder.dump(triggerClose, conn.abnormal)
+				}
+
+				for _, line := range registry.mapping() {
+					logger.WithFields(logrus.Fields{
+						fieldLevel: levelConnection,
+					}).Info(line)
+				}
+
+				for name := range sessionLoggers {
+					_ = destroyLogger(name)
+				}
+
+				for name := range consoleLoggers {
+					_ = destroyLogger(name)
 				}
 				break loop
 			}
 
-			if msg.HasSessionId() {
-				var targetLogger *logrus.Entry
+			levels, err := unwrapMessage(msg)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					fieldLevel: levelConnection,
+				}).Errorf("Could not deserialize message: %+v", err)
+			}
 
-				targetRequests, exists := sessions[msg.TargetID()]
-				if !exists {
-					targetRequests = make(map[uint64]*protocolMessage)
-					sessions[msg.TargetID()] = targetRequests
+			// envelopes are acknowledged with empty responses which are not worth displaying
+			for i, level := range levels[:len(levels)-1] {
+				if level.message.IsRequest() {
+					pendingRequests(level.sessionID)[level.message.ID] = nil
 				}
 
-				if *flagDistributeLogs {
-					logger, err := createLogger(fmt.Sprintf("session-%s", msg.TargetID()))
+				registry.nest(level.sessionID, levels[i+1].sessionID)
+			}
 
-					if err != nil {
-						panic(fmt.Sprintf("could not create logger: %v", err))
-					}
+			current := levels[len(levels)-1]
+			message := current.message
+			targetRequests := pendingRequests(current.sessionID)
 
-					targetLogger = logger.WithFields(logrus.Fields{
-						fieldLevel:    levelTarget,
-						fieldTargetID: msg.TargetID(),
-					})
+			var targetLogger *logrus.Entry
 
-				} else {
-					targetLogger = logger.WithFields(logrus.Fields{
-						fieldLevel:    levelTarget,
-						fieldTargetID: msg.TargetID(),
-					})
+			if current.sessionID == "" {
+				targetLogger = frameLogger.WithFields(logrus.Fields{
+					fieldLevel:    levelProtocol,
+					fieldTargetID: conn.column(""),
+				})
+			} else if *flagDistributeLogs && conn.recorder == nil {
+				name := conn.logName("session-" + current.sessionID)
+				logger, err := createLogger(name)
+
+				if err != nil {
+					panic(fmt.Sprintf("could not create logger: %v", err))
 				}
 
-				if msg.IsRequest() {
-					requests[msg.ID] = nil
+				conn.wrote(logFilePath(name))
+				sessionLoggers[name] = true
 
-					if protocolMessage, err := decodeProtocolMessage(msg); err == nil {
-						targetRequests[protocolMessage.ID] = protocolMessage
+				targetLogger = logger.WithFields(logrus.Fields{
+					fieldLevel:    levelTarget,
+					fieldTargetID: conn.column(current.sessionID),
+					fieldLabel:    conn.label,
+				})
 
-						if *flagShowRequests {
-							targetLogger.WithFields(logrus.Fields{
-								fieldType:   typeRequest,
-								fieldMethod: protocolMessage.Method + "-(" + strconv.FormatUint(msg.ID, 10) + ")",
-							}).Info(serialize(protocolMessage.Params))
-						}
+			} else {
+				targetLogger = frameLogger.WithFields(logrus.Fields{
+					fieldLevel:    levelTarget,
+					fieldTargetID: conn.column(current.sessionID),
+				})
+			}
+
+			if message.IsRequest() {
+				redact(message.Method, message)
+				targetRequests[message.ID] = message
+
+				if conn.recorder != nil {
+					conn.recorder.record(current.sessionID, message)
+				}
+
+				if *flagTraces {
+					conn.traces.request(current.sessionID, message)
+				}
+
+				if *flagShowRequests {
+					targetLogger.WithFields(logrus.Fields{
+						fieldType:   typeRequest,
+						fieldMethod: message.Method + "-(" + strconv.FormatUint(message.ID, 10) + ")",
+					}).Info(serialize(message.Params))
+				}
+			} else if message.IsResponse() {
+				var logMessage string
+				var logType int
+				var logRequest string
+				var logMethod string
+
+				request, ok := targetRequests[message.ID]
+				delete(targetRequests, message.ID)
 
-					} else {
+				if ok && request == nil {
+					continue
+				}
+
+				// responses to unknown requests are still redacted by rules which don't depend on method
+				method := ""
+				if ok {
+					method = request.Method
+				}
+
+				redact(method, message)
+
+				if conn.recorder != nil {
+					conn.recorder.record(current.sessionID, message)
+				}
+
+				if artifactsEnabled() {
+					if err := conn.artifacts.response(current.sessionID, request, message); err != nil {
 						logger.WithFields(logrus.Fields{
 							fieldLevel: levelConnection,
-						}).Errorf("Could not deserialize message: %+v", err)
+						}).Errorf("Could not extract artifact: %v", err)
 					}
-				} else if msg.IsEvent() {
-					if protocolMessage, err := decodeProtocolMessage(msg); err == nil {
-						if protocolMessage.IsEvent() {
-							targetLogger.WithFields(logrus.Fields{
-								fieldType:   typeEvent,
-								fieldMethod: protocolMessage.Method,
-							}).Info(serialize(protocolMessage.Params))
-						} else if protocolMessage.IsResponse() {
-							var logMessage string
-							var logType int
-							var logRequest string
-							var logMethod string
-
-							if protocolMessage.IsError() {
-								logMessage = serialize(protocolMessage.Error)
-								logType = typeRequestResponseError
-							} else {
-								logMessage = serialize(protocolMessage.Result)
-								logType = typeRequestResponse
-							}
-
-							if request, ok := targetRequests[protocolMessage.ID]; ok && request != nil {
-								delete(targetRequests, protocolMessage.ID)
-								logRequest = serialize(request.Params)
-								logMethod = request.Method
-
-							} else {
-								logRequest = errorColor("could not find request with id: %d", protocolMessage.ID)
-							}
-
-							if *flagShowRequests {
-								logMethod += "*(" + strconv.FormatUint(msg.ID, 10) + ")"
-							} else {
-								logMethod += "*"
-							}
-
-							targetLogger.WithFields(logrus.Fields{
-								fieldType:    logType,
-								fieldMethod:  logMethod,
-								fieldRequest: logRequest,
-							}).Info(logMessage)
-						} else {
-							targetLogger.WithFields(logrus.Fields{
-								fieldType:   typeRequest,
-								fieldMethod: msg.Method,
-							}).Info("Could not understand session event: " + msg.raw)
-						}
-					} else {
+				}
+
+				if *flagTraces {
+					path, err := conn.traces.response(current.sessionID, request, message)
+					conn.logArtifact("performance data", current.sessionID, path, err)
+				}
+
+				if message.IsError() {
+					logMessage = serialize(message.Error)
+					logType = typeRequestResponseError
+				} else {
+					logMessage = serialize(message.Result)
+					logType = typeRequestResponse
+				}
+
+				if ok {
+					logRequest = serialize(request.Params)
+					logMethod = request.Method
+				} else {
+					logRequest = errorColor("could not find request with id: %d", message.ID)
+				}
+
+				if *flagShowRequests {
+					logMethod += "*(" + strconv.FormatUint(message.ID, 10) + ")"
+				} else {
+					logMethod += "*"
+				}
+
+				targetLogger.WithFields(logrus.Fields{
+					fieldType:    logType,
+					fieldMethod:  logMethod,
+					fieldRequest: logRequest,
+				}).Info(logMessage)
+			} else if message.IsEvent() {
+				redact(message.Method, message)
+				registry.observe(message, current.sessionID)
+
+				if conn.recorder != nil {
+					conn.recorder.record(current.sessionID, message)
+				}
+
+				if artifactsEnabled() {
+					if err := conn.artifacts.event(current.sessionID, message); err != nil {
 						logger.WithFields(logrus.Fields{
 							fieldLevel: levelConnection,
-						}).Errorf("Could not deserialize message: %+v", err)
+						}).Errorf("Could not extract artifact: %v", err)
 					}
-				} else if msg.IsResponse() {
-					var logMessage string
-					var logType int
-					var logRequest string
-					var logMethod string
-
-					if msg.IsError() {
-						logMessage = serialize(msg.Error)
-						logType = typeRequestResponseError
-					} else {
-						logMessage = serialize(msg.Result)
-						logType = typeRequestResponse
+
+					if message.Method == "Target.detachedFromTarget" {
+						conn.closeArtifacts(asString(message.Params["sessionId"]))
 					}
+				}
 
-					if request, ok := targetRequests[msg.ID]; ok && request != nil {
-						delete(targetRequests, msg.ID)
-						logRequest = serialize(request.Params)
-						logMethod = request.Method
+				if *flagTraces {
+					path, err := conn.traces.event(current.sessionID, message)
+					conn.logArtifact("performance data", current.sessionID, path, err)
+				}
+
+				if *flagWaterfall {
+					conn.waterfall.observe(current.sessionID, message)
 
-					} else {
-						logRequest = errorColor("could not find request with id: %d", msg.ID)
+					if message.Method == "Target.detachedFromTarget" {
+						sessionID := asString(message.Params["sessionId"])
+						conn.logWaterfall(sessionID)
+						conn.waterfall.forget(sessionID)
 					}
+				}
 
-					if *flagShowRequests {
-						logMethod += "*(" + strconv.FormatUint(msg.ID, 10) + ")"
-					} else {
-						logMethod += "*"
+				if entry, ok := consoleMessage(message); ok && (*flagConsole || *flagConsoleFile) {
+					fields := logrus.Fields{
+						fieldType:   typeConsole,
+						fieldMethod: "console." + entry.level,
 					}
 
-					targetLogger.WithFields(logrus.Fields{
-						fieldType:    logType,
-						fieldMethod:  logMethod,
-						fieldRequest: logRequest,
-					}).Info(logMessage)
+					level := logrus.InfoLevel
+					if entry.isError() {
+						level = logrus.ErrorLevel
+					}
 
-				} else {
-					targetLogger.WithFields(logrus.Fields{
-						fieldType:   typeRequest,
-						fieldMethod: msg.Method,
-					}).Info("Could not understand session message: " + msg.raw)
-				}
+					if *flagConsoleFile {
+						name := "console-" + conn.id
+						if current.sessionID != "" {
+							name = conn.logName("console-" + current.sessionID)
+						}
 
-			} else {
-				protocolLogger := logger.WithFields(logrus.Fields{
-					fieldLevel:    levelProtocol,
-					fieldTargetID: protocolTargetID,
-				})
+						consoleLogger, err := createFileLogger(name)
+						if err != nil {
+							panic(fmt.Sprintf("could not create logger: %v", err))
+						}
 
-				if msg.IsRequest() {
-					requests[msg.ID] = msg
+						conn.wrote(logFilePath(name))
 
-					if *flagShowRequests {
-						protocolLogger.WithFields(logrus.Fields{
-							fieldType:   typeRequest,
-							fieldMethod: msg.Method + "-(" + strconv.FormatUint(msg.ID, 10) + ")",
-						}).Info(serialize(msg.Params))
-					}
-				} else if msg.IsResponse() {
-
-					var logMessage string
-					var logType int
-					var logRequest string
-					var logMethod string
-
-					if msg.IsError() {
-						logMessage = serialize(msg.Error)
-						logType = typeRequestResponseError
-					} else {
-						logMessage = serialize(msg.Result)
-						logType = typeRequestResponse
+						consoleLoggers[name] = true
+						consoleLogger.WithFields(targetLogger.Data).WithFields(fields).Log(level, entry.String())
 					}
 
-					if request, ok := requests[msg.ID]; ok && request != nil {
-						logRequest = serialize(request.Params)
-						logMethod = request.Method
-
-						delete(requests, msg.ID)
-
-						protocolLogger.WithFields(logrus.Fields{
-							fieldType:    logType,
-							fieldMethod:  logMethod,
-							fieldRequest: logRequest,
-						}).Info(logMessage)
+					if *flagConsole {
+						targetLogger.WithFields(fields).Log(level, entry.String())
+						continue
 					}
-				} else if msg.IsEvent() {
-					protocolLogger.WithFields(logrus.Fields{
-						fieldType:   typeEvent,
-						fieldMethod: msg.Method,
-					}).Info(serialize(msg.Params))
-				} else {
-					protocolLogger.WithFields(logrus.Fields{
-						fieldType:   typeRequest,
-						fieldMethod: msg.Method,
-					}).Info("Could not understand message: " + msg.raw)
 				}
+
+				targetLogger.WithFields(logrus.Fields{
+					fieldType:   typeEvent,
+					fieldMethod: message.Method,
+				}).Info(serialize(message.Params))
+			} else {
+				targetLogger.WithFields(logrus.Fields{
+					fieldType:   typeRequest,
+					fieldMethod: message.Method,
+				}).Info("Could not understand message: " + redactText(message.raw))
 			}
 		}
 	}
 }
 
-func checkVersion() (map[string]string, error) {
-	cl := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+*flagRemote+"/json/version", nil)
+// setupBrowser connects to the browser over pipe or launches it according to -pipe and -launch flags.
+func setupBrowser(pool *upstreamPool, logger *logrus.Entry) (*pipeBrowser, *browserProcess, error) {
+	if strings.HasPrefix(*flagPipe, pipeFdPrefix) {
+		pipe, err := openPipe(*flagPipe)
+		return pipe, nil, err
+	}
+
+	commandLine := *flagLaunch
+	if *flagPipe != "" {
+		if *flagLaunch != "" {
+			return nil, nil, errors.New("only one of -pipe and -launch can be used")
+		}
+
+		commandLine = *flagPipe + " " + pipeFlag
+	}
+
+	if commandLine == "" {
+		return nil, nil, nil
+	}
+
+	remote := pool.single()
+	if remote == nil {
+		return nil, nil, errors.New("browser can be launched only with single remote")
+	}
+
+	args, err := splitCommandLine(commandLine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid browser command: %v", err)
+	}
+
+	var pipe *pipeBrowser
+	if hasArgument(args, pipeFlag) {
+		pipe = newPipeBrowser()
+	}
+
+	browser, err := launchBrowser(commandLine, remote, pipe, logger)
+	return pipe, browser, err
+}
+
+func checkVersion(remote *upstream) (map[string]string, error) {
+	cl := &http.Client{Transport: remote.transport()}
+	req, err := http.NewRequest("GET", remote.httpURL("/json/version"), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// ownership tracks targets and browser contexts created by the client of a connection.
+type ownership struct {
+	sync.Mutex
+	targets  map[string]bool
+	contexts map[string]bool
+}
+
+func newOwnership() *ownership {
+	return &ownership{
+		targets:  make(map[string]bool),
+		contexts: make(map[string]bool),
+	}
+}
+
+func (o *ownership) intercept(dir direction, f *frame) (bool, error) {
+	msg := f.message()
+	if dir != toClient || msg == nil {
+		return false, nil
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if msg.IsResponse() && f.request != nil && msg.Result != nil {
+		switch f.request.Method {
+		case "Target.createTarget":
+			o.targets[asString(msg.Result["targetId"])] = true
+		case "Target.createBrowserContext":
+			o.contexts[asString(msg.Result["browserContextId"])] = true
+		case "Target.disposeBrowserContext":
+			delete(o.contexts, asString(f.request.Params["browserContextId"]))
+		}
+	}
+
+	switch msg.Method {
+	case "Target.targetCreated":
+		info, _ := msg.Params["targetInfo"].(map[string]interface{})
+		openerID, _ := info["openerId"].(string)
+		contextID, _ := info["browserContextId"].(string)
+
+		if o.targets[openerID] || o.contexts[contextID] {
+			o.targets[asString(info["targetId"])] = true
+		}
+
+	case "Target.targetDestroyed":
+		delete(o.targets, asString(msg.Params["targetId"]))
+	}
+
+	return false, nil
+}
+
+func (o *ownership) ownsTarget(targetID string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.targets[targetID]
+}
+
+// owned returns ids of targets and browser contexts created by the client.
+func (o *ownership) owned() ([]string, []string) {
+	o.Lock()
+	defer o.Unlock()
+
+	var targets, contexts []string
+
+	for targetID := range o.targets {
+		targets = append(targets, targetID)
+	}
+
+	for contextID := range o.contexts {
+		contexts = append(contexts, contextID)
+	}
+
+	sort.Strings(targets)
+	sort.Strings(contexts)
+
+	return targets, contexts
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	pipeFlag       = "--remote-debugging-pipe"
+	pipeFdPrefix   = "fd:"
+	pipeVersionID  = 1
+	pipeBrowserURL = "/devtools/browser/pipe"
+)
+
+var errPipeBusy = errors.New("browser pipe is already used by another client")
+var errPipeClosed = errors.New("browser pipe is closed")
+
+// pipeBrowser speaks with the browser started with --remote-debugging-pipe using NUL-delimited JSON messages
+// and lends the pipe to one websocket client at a time.
+type pipeBrowser struct {
+	sync.Mutex
+	// writing serializes writes to the pipe without blocking readers of its state
+	writing    sync.Mutex
+	writer     io.WriteCloser
+	closers    []io.Closer
+	version    map[string]string
+	session    *pipeSession
+	generation int
+	closed     bool
+}
+
+func newPipeBrowser() *pipeBrowser {
+	return &pipeBrowser{closed: true}
+}
+
+// openPipe uses inherited file descriptors given as fd:<write fd>,<read fd>.
+func openPipe(definition string) (*pipeBrowser, error) {
+	fds, _ := strings.CutPrefix(definition, pipeFdPrefix)
+
+	writeFd, readFd, found := strings.Cut(fds, ",")
+	if !found {
+		return nil, fmt.Errorf("invalid pipe %s: expected fd:<write fd>,<read fd>", definition)
+	}
+
+	w, err := strconv.Atoi(writeFd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipe %s: %v", definition, err)
+	}
+
+	r, err := strconv.Atoi(readFd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipe %s: %v", definition, err)
+	}
+
+	p := newPipeBrowser()
+	if err := p.attach(os.NewFile(uintptr(w), "pipe-write"), os.NewFile(uintptr(r), "pipe-read")); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// pipeCommand prepares command with --remote-debugging-pipe and pipes passed as file descriptors 3 (commands) and 4 (messages).
+func pipeCommand(name string, args ...string) (*exec.Cmd, *os.File, *os.File, error) {
+	commandsReader, commandsWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	messagesReader, messagesWriter, err := os.Pipe()
+	if err != nil {
+		commandsReader.Close()
+		commandsWriter.Close()
+		return nil, nil, nil, err
+	}
+
+	if !hasArgument(args, pipeFlag) {
+		args = append(args, pipeFlag)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.ExtraFiles = []*os.File{commandsReader, messagesWriter}
+
+	return cmd, commandsWriter, messagesReader, nil
+}
+
+// attach starts talking with the browser over given pipe, asking it for its version first.
+// Client of the previously attached browser, if any, is disconnected.
+func (p *pipeBrowser) attach(writer io.WriteCloser, reader io.ReadCloser) error {
+	buffered := bufio.NewReader(reader)
+
+	version, err := fetchPipeVersion(writer, buffered)
+	if err != nil {
+		writer.Close()
+		reader.Close()
+		return fmt.Errorf("could not get browser version over pipe: %v", err)
+	}
+
+	p.Lock()
+	p.detach(p.generation)
+	p.generation++
+	p.writer = writer
+	p.closers = []io.Closer{writer, reader}
+	p.version = version
+	p.closed = false
+	generation := p.generation
+	p.Unlock()
+
+	go p.read(buffered, generation)
+
+	return nil
+}
+
+func fetchPipeVersion(writer io.Writer, reader *bufio.Reader) (map[string]string, error) {
+	if _, err := writer.Write([]byte(fmt.Sprintf(`{"id":%d,"method":"Browser.getVersion"}`+"\x00", pipeVersionID))); err != nil {
+		return nil, err
+	}
+
+	for {
+		data, err := readPipeMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		var response struct {
+			ID     int64             `json:"id"`
+			Result map[string]string `json:"result"`
+		}
+
+		if json.Unmarshal(data, &response) != nil || response.ID != pipeVersionID {
+			continue
+		}
+
+		return map[string]string{
+			"Browser":          response.Result["product"],
+			"Protocol-Version": response.Result["protocolVersion"],
+			"User-Agent":       response.Result["userAgent"],
+			"V8-Version":       response.Result["jsVersion"],
+			"WebKit-Version":   response.Result["revision"],
+		}, nil
+	}
+}
+
+// readPipeMessage reads single NUL-terminated message from the pipe.
+func readPipeMessage(reader *bufio.Reader) ([]byte, error) {
+	data, err := reader.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return data[:len(data)-1], nil
+}
+
+func (p *pipeBrowser) write(data []byte) error {
+	p.Lock()
+	closed, writer := p.closed, p.writer
+	p.Unlock()
+
+	if closed {
+		return errPipeClosed
+	}
+
+	message := make([]byte, len(data)+1)
+	copy(message, data)
+
+	p.writing.Lock()
+	defer p.writing.Unlock()
+
+	_, err := writer.Write(message)
+	return err
+}
+
+// read delivers messages from the browser to the current session, dropping them if there is none.
+func (p *pipeBrowser) read(reader *bufio.Reader, generation int) {
+	for {
+		data, err := readPipeMessage(reader)
+		if err != nil {
+			p.Lock()
+			p.detach(generation)
+			p.Unlock()
+
+			return
+		}
+
+		p.Lock()
+		session := p.session
+		p.Unlock()
+
+		if session != nil {
+			session.deliver(data)
+		}
+	}
+}
+
+// detach closes the pipe and disconnects its client if given generation of the pipe is still attached.
+func (p *pipeBrowser) detach(generation int) {
+	if p.closed || p.generation != generation {
+		return
+	}
+
+	p.closed = true
+	for _, closer := range p.closers {
+		closer.Close()
+	}
+
+	if p.session != nil {
+		p.session.closeWith(errPipeClosed)
+		p.session = nil
+	}
+}
+
+func (p *pipeBrowser) close() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.detach(p.generation)
+}
+
+// open lends the pipe to a client until returned session is closed.
+func (p *pipeBrowser) open() (*pipeSession, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return nil, errPipeClosed
+	}
+
+	if p.session != nil {
+		return nil, errPipeBusy
+	}
+
+	p.session = &pipeSession{
+		browser:  p,
+		messages: make(chan []byte, 1024),
+		done:     make(chan struct{}),
+	}
+
+	return p.session, nil
+}
+
+func (p *pipeBrowser) release(session *pipeSession) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.session == session {
+		p.session = nil
+	}
+}
+
+// browserVersion returns version of the browser in format of /json/version.
+func (p *pipeBrowser) browserVersion() map[string]string {
+	p.Lock()
+	defer p.Unlock()
+
+	version := make(map[string]string)
+	for key, value := range p.version {
+		version[key] = value
+	}
+
+	return version
+}
+
+// ServeHTTP serves /json endpoints synthesized for the browser behind the pipe.
+func (p *pipeBrowser) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	scheme := "ws"
+	if listenScheme() == "https" {
+		scheme = "wss"
+	}
+
+	switch strings.TrimSuffix(req.URL.Path, "/") {
+	case "/json/version":
+		version := p.browserVersion()
+		version["webSocketDebuggerUrl"] = scheme + "://" + req.Host + pipeBrowserURL
+
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(version)
+
+	case "/json", "/json/list":
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte("[]\n"))
+
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// pipeSession is a messageConn of a single client talking with the browser over the pipe.
+type pipeSession struct {
+	browser  *pipeBrowser
+	messages chan []byte
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+func (s *pipeSession) deliver(data []byte) {
+	select {
+	case s.messages <- data:
+	case <-s.done:
+	}
+}
+
+func (s *pipeSession) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-s.messages:
+		return websocket.TextMessage, data, nil
+	case <-s.done:
+		return 0, nil, s.err
+	}
+}
+
+func (s *pipeSession) WriteMessage(_ int, data []byte) error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+
+	return s.browser.write(data)
+}
+
+func (s *pipeSession) closeWith(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+func (s *pipeSession) Close() error {
+	s.closeWith(io.EOF)
+	s.browser.release(s)
+
+	return nil
+}
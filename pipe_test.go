@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// helperEnv selects role of the test binary when it is started as a stand-in browser.
+const helperEnv = "CPP_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "pipe-browser":
+		pipeBrowserHelper()
+		os.Exit(0)
+	case "launcher-browser":
+		launcherBrowserHelper()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// pipeBrowserHelper reads NUL-delimited commands from fd 3 and answers them on fd 4, splitting every message
+// into several writes so that the proxy has to reassemble it.
+func pipeBrowserHelper() {
+	reader := bufio.NewReader(os.NewFile(3, "commands"))
+	writer := os.NewFile(4, "messages")
+
+	for {
+		data, err := reader.ReadBytes(0)
+		if err != nil {
+			return
+		}
+
+		var command struct {
+			ID     int64  `json:"id"`
+			Method string `json:"method"`
+		}
+		json.Unmarshal(data[:len(data)-1], &command)
+
+		switch command.Method {
+		case "Browser.getVersion":
+			writeSplit(writer, fmt.Sprintf(`{"id":%d,"result":{"product":"Helper/1.0","protocolVersion":"1.3"}}`+"\x00", command.ID))
+		case "Test.burst":
+			// two messages in a single write
+			writer.Write([]byte(fmt.Sprintf(`{"method":"Test.event","params":{}}`+"\x00"+`{"id":%d,"result":{}}`+"\x00", command.ID)))
+		default:
+			writeSplit(writer, fmt.Sprintf(`{"id":%d,"result":{"method":%q}}`+"\x00", command.ID, command.Method))
+		}
+	}
+}
+
+func writeSplit(writer *os.File, message string) {
+	for i := 0; i < len(message); i += 7 {
+		end := i + 7
+		if end > len(message) {
+			end = len(message)
+		}
+
+		writer.Write([]byte(message[i:end]))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func startPipeBrowser(t *testing.T) *pipeBrowser {
+	cmd, writer, reader, err := pipeCommand(os.Args[0], "-test.run=^$")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Env = append(os.Environ(), helperEnv+"=pipe-browser")
+
+	err = cmd.Start()
+	for _, file := range cmd.ExtraFiles {
+		file.Close()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	browser := newPipeBrowser()
+	if err := browser.attach(writer, reader); err != nil {
+		t.Fatal(err)
+	}
+
+	return browser
+}
+
+func readPipeSession(t *testing.T, session *pipeSession) string {
+	result := make(chan string, 1)
+
+	go func() {
+		_, data, err := session.ReadMessage()
+		if err != nil {
+			result <- "error: " + err.Error()
+			return
+		}
+
+		result <- string(data)
+	}()
+
+	select {
+	case message := <-result:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout reading from pipe")
+		return ""
+	}
+}
+
+func TestPipeFraming(t *testing.T) {
+	browser := startPipeBrowser(t)
+
+	if version := browser.browserVersion(); version["Browser"] != "Helper/1.0" || version["Protocol-Version"] != "1.3" {
+		t.Fatalf("unexpected version %v", version)
+	}
+
+	session, err := browser.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.WriteMessage(0, []byte(`{"id":2,"method":"Page.navigate"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if message := readPipeSession(t, session); message != `{"id":2,"result":{"method":"Page.navigate"}}` {
+		t.Fatalf("unexpected message reassembled from partial reads: %s", message)
+	}
+
+	if err := session.WriteMessage(0, []byte(`{"id":3,"method":"Test.burst"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`{"method":"Test.event","params":{}}`, `{"id":3,"result":{}}`} {
+		if message := readPipeSession(t, session); message != expected {
+			t.Fatalf("expected %s, got %s", expected, message)
+		}
+	}
+}
+
+func TestPipeLentToOneClient(t *testing.T) {
+	browser := startPipeBrowser(t)
+
+	first, err := browser.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := browser.open(); !errors.Is(err, errPipeBusy) {
+		t.Fatalf("expected second client to be rejected, got %v", err)
+	}
+
+	first.Close()
+
+	if err := first.WriteMessage(0, []byte(`{"id":2,"method":"Page.navigate"}`)); err == nil {
+		t.Fatal("expected closed session to reject writes")
+	}
+
+	second, err := browser.open()
+	if err != nil {
+		t.Fatalf("expected pipe to be lent again after the client closed, got %v", err)
+	}
+
+	if err := second.WriteMessage(0, []byte(`{"id":4,"method":"Page.reload"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if message := readPipeSession(t, second); message != `{"id":4,"result":{"method":"Page.reload"}}` {
+		t.Fatalf("unexpected message %s", message)
+	}
+
+	browser.close()
+
+	if message := readPipeSession(t, second); message != "error: "+errPipeClosed.Error() {
+		t.Fatalf("expected client to be disconnected when pipe is closed, got %s", message)
+	}
+}
+
+func TestPipeWriteKeepsCallerBuffer(t *testing.T) {
+	browser := startPipeBrowser(t)
+
+	session, err := browser.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	command := []byte(`{"id":2,"method":"Page.navigate"}`)
+	buffer := append(make([]byte, 0, len(command)+1), command...)
+	spare := buffer[:len(command)+1]
+	spare[len(command)] = 'x'
+
+	if err := session.WriteMessage(0, buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if spare[len(command)] != 'x' {
+		t.Fatal("expected write not to touch spare capacity of the caller's buffer")
+	}
+
+	if message := readPipeSession(t, session); message != `{"id":2,"result":{"method":"Page.navigate"}}` {
+		t.Fatalf("unexpected message %s", message)
+	}
+}
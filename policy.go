@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	policyAllow     = "allow"
+	policyDeny      = "deny"
+	policyErrorCode = -32000
+)
+
+var policyAllowed = &argumentList{name: "allow", values: []string{}}
+var policyDenied = &argumentList{name: "deny", values: []string{}}
+
+func init() {
+	flag.Var(policyAllowed, "allow", "allow only commands matching <method>[?<param>=<value>&...], others are denied")
+	flag.Var(policyDenied, "deny", "deny commands matching <method>[?<param>=<value>&...]")
+}
+
+type policyRule struct {
+	Method      string                 `json:"method"`
+	Action      string                 `json:"action"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	OwnedTarget *bool                  `json:"ownedTarget,omitempty"`
+	Message     string                 `json:"message,omitempty"`
+}
+
+func (r *policyRule) String() string {
+	description := r.Action + " " + r.Method
+
+	var conditions []string
+	for path, value := range r.Params {
+		conditions = append(conditions, fmt.Sprintf("%s=%v", path, value))
+	}
+
+	if r.OwnedTarget != nil {
+		conditions = append(conditions, fmt.Sprintf("ownedTarget=%t", *r.OwnedTarget))
+	}
+
+	if len(conditions) > 0 {
+		description += "?" + strings.Join(conditions, "&")
+	}
+
+	return description
+}
+
+// matches reports whether command sent by the client owning given targets matches the rule.
+func (r *policyRule) matches(command *protocolMessage, owned *ownership) bool {
+	if !matchMethod(r.Method, command.Method) {
+		return false
+	}
+
+	for path, expected := range r.Params {
+		if !matchValue(expected, lookup(command.Params, path)) {
+			return false
+		}
+	}
+
+	if r.OwnedTarget != nil {
+		targetID, ok := command.Params["targetId"].(string)
+		if !ok || owned.ownsTarget(targetID) != *r.OwnedTarget {
+			return false
+		}
+	}
+
+	return true
+}
+
+type policy struct {
+	Default string        `json:"default"`
+	Rules   []*policyRule `json:"rules"`
+}
+
+var commandPolicy *policy
+
+// loadPolicy builds command policy from -policy file and -allow and -deny flags.
+func loadPolicy() error {
+	if *flagPolicy == "" && len(policyAllowed.values) == 0 && len(policyDenied.values) == 0 {
+		return nil
+	}
+
+	commandPolicy = &policy{Default: policyAllow}
+
+	if *flagPolicy != "" {
+		data, err := os.ReadFile(*flagPolicy)
+		if err != nil {
+			return fmt.Errorf("could not read policy: %v", err)
+		}
+
+		if err := json.Unmarshal(data, commandPolicy); err != nil {
+			return fmt.Errorf("could not parse policy %s: %v", *flagPolicy, err)
+		}
+	}
+
+	for _, definition := range policyDenied.values {
+		rule, err := parsePolicyRule(policyDeny, definition)
+		if err != nil {
+			return err
+		}
+
+		commandPolicy.Rules = append(commandPolicy.Rules, rule)
+	}
+
+	for _, definition := range policyAllowed.values {
+		rule, err := parsePolicyRule(policyAllow, definition)
+		if err != nil {
+			return err
+		}
+
+		commandPolicy.Rules = append(commandPolicy.Rules, rule)
+		commandPolicy.Default = policyDeny
+	}
+
+	for _, rule := range commandPolicy.Rules {
+		if rule.Action != policyAllow && rule.Action != policyDeny {
+			return fmt.Errorf("invalid policy rule %s: action must be allow or deny", rule)
+		}
+	}
+
+	if commandPolicy.Default != policyAllow && commandPolicy.Default != policyDeny {
+		return fmt.Errorf("invalid policy: default must be allow or deny")
+	}
+
+	return nil
+}
+
+func parsePolicyRule(action, definition string) (*policyRule, error) {
+	method, query, _ := strings.Cut(definition, "?")
+	rule := &policyRule{Method: method, Action: action}
+
+	conditions, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy rule %q: %v", definition, err)
+	}
+
+	for path := range conditions {
+		value := conditions.Get(path)
+
+		if path == "ownedTarget" {
+			owned, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy rule %q: %v", definition, err)
+			}
+
+			rule.OwnedTarget = &owned
+			continue
+		}
+
+		if rule.Params == nil {
+			rule.Params = make(map[string]interface{})
+		}
+
+		rule.Params[path] = value
+	}
+
+	return rule, nil
+}
+
+// evaluate returns rule which denies the command or nil if command is allowed.
+func (p *policy) evaluate(command *protocolMessage, owned *ownership) *policyRule {
+	for _, rule := range p.Rules {
+		if rule.matches(command, owned) {
+			if rule.Action == policyDeny {
+				return rule
+			}
+
+			return nil
+		}
+	}
+
+	if p.Default == policyDeny {
+		return &policyRule{Method: "*", Action: policyDeny}
+	}
+
+	return nil
+}
+
+// policyEnforcer rejects commands denied by policy before they reach the browser.
+type policyEnforcer struct {
+	conn   *connection
+	policy *policy
+}
+
+func (p *policyEnforcer) intercept(dir direction, f *frame) (bool, error) {
+	command := f.message()
+	if dir != toBrowser || command == nil || !command.IsRequest() {
+		return false, nil
+	}
+
+	rule := p.policy.evaluate(command, p.conn.owned)
+	if rule == nil {
+		return false, nil
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = fmt.Sprintf("%s is not allowed by proxy policy", command.Method)
+	}
+
+	p.conn.logger.Errorf("policy violation: %s denied by rule %s in %s", command.Method, rule, p.conn.sessionLabel(f.sessionID()))
+
+	return true, p.conn.replyError(f, policyErrorCode, message)
+}
+
+// lookup returns value at dotted path within values.
+func lookup(values map[string]interface{}, path string) interface{} {
+	var current interface{} = values
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		current = object[key]
+	}
+
+	return current
+}
+
+func matchValue(expected, actual interface{}) bool {
+	if reflect.DeepEqual(expected, actual) {
+		return true
+	}
+
+	if text, ok := expected.(string); ok && actual != nil {
+		return text == asString(actual)
+	}
+
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// recordingConn keeps messages written to it.
+type recordingConn struct {
+	written [][]byte
+}
+
+func (r *recordingConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, io.EOF
+}
+
+func (r *recordingConn) WriteMessage(messageType int, data []byte) error {
+	r.written = append(r.written, data)
+	return nil
+}
+
+func (r *recordingConn) Close() error {
+	return nil
+}
+
+func TestDuplicateKey(t *testing.T) {
+	cases := map[string]string{
+		`{"id":1,"method":"Browser.close"}`:                             "",
+		`{"id":1,"method":"Browser.close","Method":"Runtime.evaluate"}`: "Method",
+		`{"id":1,"method":"Browser.close","method":"Runtime.evaluate"}`: "method",
+		`{"id":1,"ID":2,"method":"Browser.close"}`:                      "ID",
+		`{"id":1,"method":"Runtime.evaluate","params":{"a":1,"A":2}}`:   "",
+		`{"id":1,"params":{"message":"a","message":"b"}}`:               "params.message",
+		`{"id":1,"params":{"list":[{"a":1},{"a":2,"a":3}]}}`:            "params.list.a",
+		`[1,2]`:     "",
+		`not json`:  "",
+		`{"id":1,}`: "",
+	}
+
+	for data, expected := range cases {
+		if key := duplicateKey([]byte(data)); key != expected {
+			t.Errorf("duplicateKey(%s) = %q, expected %q", data, key, expected)
+		}
+	}
+
+	// encoding/json folds long s to s, so does the check
+	if key := duplicateKey([]byte(`{"ſtatus":1,"status":2}`)); key != "status" {
+		t.Errorf("expected status differing in folded case, got %q", key)
+	}
+}
+
+// policyConnection returns connection denying Browser.close along with fakes of its client and browser.
+func policyConnection(t *testing.T) (*connection, *recordingConn, *recordingConn) {
+	denied, err := parsePolicyRule(policyDeny, "Browser.close")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	conn := newConnection("test", "127.0.0.1:1", logrus.NewEntry(logger))
+	client, browser := &recordingConn{}, &recordingConn{}
+	conn.client, conn.browser = newWsWriter(client), newWsWriter(browser)
+	conn.interceptors = []interceptor{&policyEnforcer{conn: conn, policy: &policy{Default: policyAllow, Rules: []*policyRule{denied}}}}
+
+	return conn, client, browser
+}
+
+// innermostReply decodes the last reply, unwrapping it from Target.receivedMessageFromTarget envelopes.
+func innermostReply(t *testing.T, written [][]byte) *protocolMessage {
+	if len(written) == 0 {
+		t.Fatal("expected reply to the client")
+	}
+
+	reply, err := decodeMessage(written[len(written)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	levels, err := unwrapMessage(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return levels[len(levels)-1].message
+}
+
+func TestPolicyRejectsUndecidableCommands(t *testing.T) {
+	envelope := func(message string) string {
+		data, _ := json.Marshal(message)
+		return `{"id":1,"method":"Target.sendMessageToTarget","params":{"sessionId":"S1","message":` + string(data) + `}}`
+	}
+
+	cases := []struct {
+		data string
+		id   uint64
+		code int64
+	}{
+		{`{"id":2,"method":"Browser.close"}`, 2, policyErrorCode},
+		{`{"id":3,"method":"Browser.close","error":"x"}`, 3, policyErrorCode},
+		{`{"id":4,"method":"Browser.close","result":[]}`, 4, policyErrorCode},
+		{`{"id":5.0,"method":"Browser.close"}`, 5, policyErrorCode},
+		{envelope(`{"id":6,"method":"Browser.close","error":1}`), 6, policyErrorCode},
+		{`{"id":7,"method":"Browser.close","Method":"Runtime.evaluate"}`, 7, invalidRequestErrorCode},
+		{envelope(`{"id":8,"method":"Browser.close","METHOD":"Runtime.evaluate"}`), 8, invalidRequestErrorCode},
+		{envelope(`{"id":9,"method":"Runtime.evaluate","method":"Browser.close"}`), 9, invalidRequestErrorCode},
+		{`{"id":10,"method":"Target.sendMessageToTarget","params":{"sessionId":"S1","message":"{\"id\":11,\"method\":\"Runtime.evaluate\"}","message":"{\"id\":11,\"method\":\"Browser.close\"}"}}`, 11, invalidRequestErrorCode},
+		{envelope(`not json`), 1, invalidRequestErrorCode},
+		{`{"id":0,"method":"Browser.close"}`, 0, invalidRequestErrorCode},
+		{`{"id":-1,"method":"Browser.close"}`, 0, invalidRequestErrorCode},
+		{`{"id":12.5,"method":"Browser.close"}`, 0, invalidRequestErrorCode},
+		{`not json`, 0, invalidRequestErrorCode},
+	}
+
+	for _, c := range cases {
+		conn, client, browser := policyConnection(t)
+
+		if err := conn.forward(toBrowser, websocket.TextMessage, []byte(c.data)); err != nil {
+			t.Fatalf("could not forward %s: %v", c.data, err)
+		}
+
+		if len(browser.written) != 0 {
+			t.Errorf("expected %s not to reach the browser", c.data)
+			continue
+		}
+
+		if reply := innermostReply(t, client.written); reply.ID != c.id || reply.Error.Code != c.code {
+			t.Errorf("expected %s to be answered with id %d and code %d, got %s", c.data, c.id, c.code, reply.raw)
+		}
+	}
+}
+
+func TestPolicyForwardsAllowedCommands(t *testing.T) {
+	conn, client, browser := policyConnection(t)
+
+	frames := []string{
+		`{"id":1,"method":"Runtime.evaluate","params":{"a":1,"A":2}}`,
+		`{"id":2,"method":"Target.sendMessageToTarget","params":{"sessionId":"S1","message":"{\"id\":3,\"method\":\"Page.navigate\"}"}}`,
+	}
+
+	for _, data := range frames {
+		if err := conn.forward(toBrowser, websocket.TextMessage, []byte(data)); err != nil {
+			t.Fatalf("could not forward %s: %v", data, err)
+		}
+	}
+
+	if len(browser.written) != len(frames) || len(client.written) != 0 {
+		t.Fatalf("expected allowed commands to reach the browser, got %q and replies %q", browser.written, client.written)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	routeRoundRobin       = "round-robin"
+	routeLeastConnections = "least-connections"
+	routeSticky           = "sticky"
+	routeQueryParam       = "cpp-route"
+	routeHeader           = "X-CDP-Proxy-Route"
+)
+
+var errUnknownTarget = errors.New("target not found on any remote")
+
+// upstreamPool routes connections to one of the browsers and keeps track of their health.
+type upstreamPool struct {
+	sync.Mutex
+	upstreams []*upstream
+	policy    string
+	next      int
+	targets   map[string]*upstream
+	logger    *logrus.Entry
+}
+
+// newUpstreamPool creates pool of remotes given in -r flag and in -remotes-file.
+func newUpstreamPool(logger *logrus.Entry) (*upstreamPool, error) {
+	switch *flagRoute {
+	case routeRoundRobin, routeLeastConnections, routeSticky:
+	default:
+		return nil, fmt.Errorf("invalid route policy %s: expected %s, %s or %s", *flagRoute, routeRoundRobin, routeLeastConnections, routeSticky)
+	}
+
+	p := &upstreamPool{
+		policy:  *flagRoute,
+		targets: make(map[string]*upstream),
+		logger:  logger,
+	}
+
+	addresses, err := remoteAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.update(addresses); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// remoteAddresses lists remotes from comma separated -r flag and from -remotes-file, one per line.
+// Default remote address is used only if there is no remotes file.
+func remoteAddresses() ([]string, error) {
+	var addresses []string
+
+	if *flagRemotesFile == "" || isFlagSet("r") {
+		for _, address := range strings.Split(*flagRemote, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	if *flagRemotesFile == "" {
+		return addresses, nil
+	}
+
+	file, err := os.Open(*flagRemotesFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read remotes: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			addresses = append(addresses, line)
+		}
+	}
+
+	return addresses, scanner.Err()
+}
+
+// update replaces remotes of the pool, keeping state of the ones which are still present.
+func (p *upstreamPool) update(addresses []string) error {
+	p.Lock()
+	existing := make(map[string]*upstream)
+	for _, u := range p.upstreams {
+		existing[u.address] = u
+	}
+	p.Unlock()
+
+	var upstreams []*upstream
+	for _, address := range addresses {
+		if u, ok := existing[address]; ok {
+			upstreams = append(upstreams, u)
+			continue
+		}
+
+		u, err := parseUpstream(address)
+		if err != nil {
+			return err
+		}
+
+		u.healthy = true
+		upstreams = append(upstreams, u)
+	}
+
+	if len(upstreams) == 0 {
+		return errors.New("no remote address given")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.upstreams = upstreams
+
+	return nil
+}
+
+// single returns the only remote of the pool or nil if there are more.
+func (p *upstreamPool) single() *upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.upstreams) != 1 {
+		return nil
+	}
+
+	return p.upstreams[0]
+}
+
+// checkHealth queries /json/version of every remote, remembering which are healthy and their browser endpoints.
+func (p *upstreamPool) checkHealth() {
+	if *flagRemotesFile != "" {
+		if addresses, err := remoteAddresses(); err != nil {
+			p.logger.Errorf("could not reload remotes: %v", err)
+		} else if err := p.update(addresses); err != nil {
+			p.logger.Errorf("could not reload remotes: %v", err)
+		}
+	}
+
+	p.Lock()
+	upstreams := append([]*upstream{}, p.upstreams...)
+	p.Unlock()
+
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+
+		go func(u *upstream) {
+			defer wg.Done()
+
+			ver, err := checkVersion(u)
+
+			p.Lock()
+			defer p.Unlock()
+
+			if healthy := err == nil; healthy != u.healthy {
+				if healthy {
+					p.logger.Infof("remote %s is healthy", u.address)
+				} else {
+					p.logger.Errorf("remote %s is unhealthy: %v", u.address, err)
+				}
+
+				u.healthy = healthy
+			}
+
+			if err == nil {
+				u.browserID = path.Base(ver["webSocketDebuggerUrl"])
+			}
+		}(u)
+	}
+
+	wg.Wait()
+}
+
+// watch checks health of remotes periodically until context is done.
+func (p *upstreamPool) watch(ctxt context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+
+		case <-ctxt.Done():
+			return
+		}
+	}
+}
+
+// route picks remote for the connection to browser or to given target and returns function releasing it.
+func (p *upstreamPool) route(basePath, id, key string) (*upstream, func(), error) {
+	var u *upstream
+	var err error
+
+	if basePath == "page" {
+		u, err = p.owner(id)
+	} else {
+		u, err = p.pick(key)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.Lock()
+	u.active++
+	p.Unlock()
+
+	return u, func() {
+		p.Lock()
+		u.active--
+		p.Unlock()
+	}, nil
+}
+
+// pick chooses one of the healthy remotes according to routing policy.
+func (p *upstreamPool) pick(key string) (*upstream, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	healthy := p.healthy()
+
+	switch {
+	case p.policy == routeSticky && key != "":
+		var best *upstream
+		var bestScore uint64
+
+		// rendezvous hashing keeps the same key on the same remote as long as it is healthy
+		for _, u := range healthy {
+			hash := fnv.New64a()
+			hash.Write([]byte(key + "\x00" + u.address))
+
+			if score := hash.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+
+		return best, nil
+
+	case p.policy == routeLeastConnections:
+		best := healthy[0]
+		for _, u := range healthy[1:] {
+			if u.active < best.active {
+				best = u
+			}
+		}
+
+		return best, nil
+	}
+
+	p.next++
+	return healthy[p.next%len(healthy)], nil
+}
+
+// healthy returns remotes which passed last health check or all of them if none did,
+// as health might have changed since it was checked.
+func (p *upstreamPool) healthy() []*upstream {
+	var healthy []*upstream
+	for _, u := range p.upstreams {
+		if u.healthy {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return append(healthy, p.upstreams...)
+	}
+
+	return healthy
+}
+
+// owner returns remote with given target, looking it up in /json/list of every remote if it is not known yet.
+func (p *upstreamPool) owner(targetID string) (*upstream, error) {
+	p.Lock()
+	u, ok := p.targets[targetID]
+	single := len(p.upstreams) == 1
+	upstreams := p.healthy()
+	p.Unlock()
+
+	if ok {
+		return u, nil
+	}
+
+	if single {
+		return upstreams[0], nil
+	}
+
+	p.listTargets(upstreams)
+
+	p.Lock()
+	defer p.Unlock()
+
+	if u, ok := p.targets[targetID]; ok {
+		return u, nil
+	}
+
+	return nil, errUnknownTarget
+}
+
+// listTargets fetches /json/list of given remotes, remembering which remote owns which target.
+func (p *upstreamPool) listTargets(upstreams []*upstream) []map[string]interface{} {
+	var all []map[string]interface{}
+	listed := make(map[*upstream]bool)
+	targets := make(map[string]*upstream)
+
+	for _, u := range upstreams {
+		list, err := fetchTargets(u)
+		if err != nil {
+			p.logger.Errorf("could not list targets of %s: %v", u.address, err)
+			continue
+		}
+
+		for _, target := range list {
+			targets[asString(target["id"])] = u
+		}
+
+		listed[u] = true
+		all = append(all, list...)
+	}
+
+	p.Lock()
+	// targets of remotes which could not be listed are kept, the rest is forgotten when destroyed
+	for targetID, u := range p.targets {
+		if !listed[u] {
+			targets[targetID] = u
+		}
+	}
+	p.targets = targets
+	p.Unlock()
+
+	return all
+}
+
+func fetchTargets(u *upstream) ([]map[string]interface{}, error) {
+	res, err := (&http.Client{Transport: u.transport()}).Get(u.httpURL("/json/list"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var list []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, errors.New("expected json result")
+	}
+
+	return list, nil
+}
+
+// ServeHTTP routes /json endpoints: lists are merged from all remotes, endpoints with target id
+// go to the remote owning the target and the rest to the remote picked according to routing policy.
+func (p *upstreamPool) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if u := p.single(); u != nil {
+		u.reverseProxy().ServeHTTP(res, req)
+		return
+	}
+
+	switch route := strings.TrimSuffix(req.URL.Path, "/"); {
+	case route == "/json" || route == "/json/list":
+		p.Lock()
+		upstreams := p.healthy()
+		p.Unlock()
+
+		list := p.listTargets(upstreams)
+		if list == nil {
+			list = []map[string]interface{}{}
+		}
+
+		for _, target := range list {
+			for _, key := range []string{"webSocketDebuggerUrl", "devtoolsFrontendUrl"} {
+				if value, ok := target[key].(string); ok {
+					target[key] = rewriteDebuggerURL(value, req.Host)
+				}
+			}
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case strings.HasPrefix(route, "/json/activate/") || strings.HasPrefix(route, "/json/close/"):
+		u, err := p.owner(path.Base(route))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		u.reverseProxy().ServeHTTP(res, req)
+
+	default:
+		u, err := p.pick(routeKey(req))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		u.reverseProxy().ServeHTTP(res, req)
+	}
+}
+
+// devtoolsPath returns path of the websocket endpoint on the remote, replacing id of the browser
+// with the one of the remote picked by routing policy.
+func (p *upstreamPool) devtoolsPath(u *upstream, basePath, id string) string {
+	p.Lock()
+	defer p.Unlock()
+
+	if basePath == "browser" && u.browserID != "" {
+		id = u.browserID
+	}
+
+	return "/devtools/" + basePath + "/" + id
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+
+	return set
+}
+
+// routeKey returns key of sticky routing given by the client, which is label of the connection unless given explicitly.
+func routeKey(req *http.Request) string {
+	if key := req.URL.Query().Get(routeQueryParam); key != "" {
+		return key
+	}
+
+	if key := req.Header.Get(routeHeader); key != "" {
+		return key
+	}
+
+	return labelFrom(req)
+}
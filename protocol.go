@@ -19,6 +19,11 @@ type protocolMessage struct {
 	SessionId string                 `json:"sessionId"`
 }
 
+type sessionMessage struct {
+	sessionID string
+	message   *protocolMessage
+}
+
 func (p *protocolMessage) String() string {
 	return fmt.Sprintf(
 		"protocolMessage{id=%d, method=%s, sessionId=%s, result=%+v, error=%+v, params=%+v}",
@@ -36,7 +41,7 @@ func (p *protocolMessage) IsError() bool {
 }
 
 func (p *protocolMessage) IsResponse() bool {
-	return p.Result != nil && p.ID > 0
+	return (p.Result != nil || p.IsError()) && p.ID > 0
 }
 
 func (p *protocolMessage) IsRequest() bool {
@@ -44,7 +49,7 @@ func (p *protocolMessage) IsRequest() bool {
 }
 
 func (p *protocolMessage) IsEvent() bool {
-	return !(p.IsRequest() || p.IsResponse())
+	return p.Method != "" && p.ID == 0
 }
 
 func (p *protocolMessage) FromTargetDomain() bool {
@@ -2,21 +2,24 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
-	"net/http"
 )
 
 const (
 	incomingBufferSize = 10 * 1024 * 1024
 	outgoingBufferSize = 25 * 1024 * 1024
+	// invalidRequestErrorCode answers commands which could be understood differently by the proxy and the browser.
+	invalidRequestErrorCode = -32600
 )
 
 var wsUpgrader = &websocket.Upgrader{
 	ReadBufferSize:  incomingBufferSize,
 	WriteBufferSize: outgoingBufferSize,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     checkOrigin,
 }
 
 var wsDialer = &websocket.Dialer{
@@ -24,29 +27,154 @@ var wsDialer = &websocket.Dialer{
 	WriteBufferSize: incomingBufferSize,
 }
 
-func proxyWS(ctxt context.Context, stream chan *protocolMessage, in, out *websocket.Conn, errc chan error) {
-	var mt int
-	var buf []byte
-	var err error
+type direction int
+
+const (
+	toBrowser direction = iota
+	toClient
+)
+
+func (d direction) String() string {
+	if d == toBrowser {
+		return "browser"
+	}
+
+	return "client"
+}
+
+// messageConn exchanges whole protocol messages with the client or the browser (over websocket or pipe).
+type messageConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// wsWriter serializes writes to websocket connection as it supports only one concurrent writer.
+// Writer of resumable client connection buffers messages while the client is disconnected.
+type wsWriter struct {
+	sync.Mutex
+	conn         messageConn
+	resumable    bool
+	suspended    bool
+	buffered     []bufferedMessage
+	bufferedSize int
+}
+
+func newWsWriter(conn messageConn) *wsWriter {
+	return &wsWriter{conn: conn}
+}
+
+func (w *wsWriter) WriteMessage(messageType int, data []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.suspended {
+		return w.buffer(messageType, data)
+	}
+
+	err := w.conn.WriteMessage(messageType, data)
+	if err != nil && w.resumable {
+		w.suspended = true
+		return w.buffer(messageType, data)
+	}
+
+	return err
+}
+
+// Close closes current connection of the writer.
+func (w *wsWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.conn.Close()
+}
+
+// frame is a single websocket message proxied between client and browser.
+type frame struct {
+	messageType int
+	data        []byte
+	levels      []sessionMessage
+	request     *protocolMessage
+	// err tells why the frame or message in one of its envelopes could not be decoded
+	err error
+}
+
+func newFrame(messageType int, data []byte) *frame {
+	f := &frame{messageType: messageType, data: data}
 
+	msg, err := decodeMessage(data)
+	if err == nil {
+		f.levels, err = unwrapMessage(msg)
+	}
+
+	f.err = err
+
+	return f
+}
+
+// message returns innermost decoded message or nil if frame could not be decoded.
+func (f *frame) message() *protocolMessage {
+	if len(f.levels) == 0 {
+		return nil
+	}
+
+	return f.levels[len(f.levels)-1].message
+}
+
+// sessionID returns id of the innermost session frame was sent through.
+func (f *frame) sessionID() string {
+	if len(f.levels) == 0 {
+		return ""
+	}
+
+	return f.levels[len(f.levels)-1].sessionID
+}
+
+// method returns method of the message or, for responses, of the request it answers.
+func (f *frame) method() string {
+	if msg := f.message(); msg != nil && msg.Method != "" {
+		return msg.Method
+	}
+
+	if f.request != nil {
+		return f.request.Method
+	}
+
+	return ""
+}
+
+// interceptor inspects frames before they are forwarded and reports whether it took care of the frame.
+type interceptor interface {
+	intercept(dir direction, f *frame) (bool, error)
+}
+
+func (c *connection) proxy(ctxt context.Context, dir direction, in messageConn, errc chan error) {
 	for {
 		select {
 		default:
-			mt, buf, err = in.ReadMessage()
+			mt, buf, err := in.ReadMessage()
 			if err != nil {
-				errc <- err
+				fail(errc, err)
 				return
 			}
 
+			c.lastFrame.Store(time.Now().UnixNano())
+
 			if msg, derr := decodeMessage(buf); derr == nil {
-				stream <- msg
+				c.publish(msg)
+
+				if dir == toClient && c.resolve(msg) {
+					continue
+				}
 			}
 
-			err = out.WriteMessage(mt, buf)
+			if err := c.forward(dir, mt, buf); err != nil {
+				fail(errc, err)
 
-			if err != nil {
-				errc <- err
-				return
+				// keep reading from the browser so that the proxy can still talk with it, i.e. to clean up
+				if dir == toBrowser {
+					return
+				}
 			}
 
 		case <-ctxt.Done():
@@ -54,3 +182,137 @@ func proxyWS(ctxt context.Context, stream chan *protocolMessage, in, out *websoc
 		}
 	}
 }
+
+// run proxies messages between the client and the browser until either side goes away or ctxt is done,
+// then cleans up after the client with -cleanup. Browser is read until cleanup finishes, so that its responses
+// to cleanup commands arrive also when the proxy shuts down.
+func (c *connection) run(ctxt context.Context, in, out messageConn) (direction, error) {
+	browserCtxt, cancelBrowser := context.WithCancel(context.Background())
+	defer cancelBrowser()
+
+	errc := make(chan error, 1)
+	go c.proxy(browserCtxt, toClient, out, errc)
+
+	dir, err := c.relay(ctxt, in, errc)
+
+	if *flagCleanup {
+		c.cleanup()
+	}
+
+	return dir, err
+}
+
+// fail reports error of the proxied connection unless another one was already reported.
+func fail(errc chan error, err error) {
+	select {
+	case errc <- err:
+	default:
+	}
+}
+
+func (c *connection) forward(dir direction, messageType int, data []byte) error {
+	// commands are tracked only if there is an interceptor or they have deadline
+	if len(c.interceptors) == 0 && *flagCommandTimeout == 0 {
+		return c.deliver(dir, &frame{messageType: messageType, data: data})
+	}
+
+	f := newFrame(messageType, data)
+
+	// interceptors would see other command than the browser if it could not be decoded or its keys were ambiguous
+	if dir == toBrowser && len(c.interceptors) > 0 {
+		if reason := c.invalidCommand(f); reason != "" {
+			c.logger.Errorf("rejecting invalid command in %s: %s", c.sessionLabel(f.sessionID()), reason)
+			return c.replyError(f, invalidRequestErrorCode, reason)
+		}
+	}
+
+	c.track(dir, f)
+
+	for _, interceptor := range c.interceptors {
+		if handled, err := interceptor.intercept(dir, f); handled || err != nil {
+			return err
+		}
+	}
+
+	return c.deliver(dir, f)
+}
+
+// invalidCommand describes why command frame can't be checked by interceptors or returns empty string if it can.
+func (c *connection) invalidCommand(f *frame) string {
+	if f.err != nil {
+		return fmt.Sprintf("message could not be decoded: %v", f.err)
+	}
+
+	for _, level := range f.levels {
+		if key := duplicateKey([]byte(level.message.raw)); key != "" {
+			return fmt.Sprintf("key %q is repeated", key)
+		}
+
+		if level.message.Method != "" && !level.message.IsRequest() {
+			return fmt.Sprintf("%s has no positive integer id", level.message.Method)
+		}
+	}
+
+	return ""
+}
+
+// deliver writes frame to the client or to the browser.
+func (c *connection) deliver(dir direction, f *frame) error {
+	if dir == toBrowser {
+		return c.browser.WriteMessage(f.messageType, f.data)
+	}
+
+	return c.client.WriteMessage(f.messageType, f.data)
+}
+
+// track remembers requests sent to the browser so that responses can be matched with them.
+func (c *connection) track(dir direction, f *frame) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, level := range f.levels {
+		key := commandKey(level.sessionID, level.message.ID)
+
+		if dir == toBrowser && level.message.IsRequest() {
+			c.commands[key] = level.message
+			c.sent[key] = time.Now()
+		} else if dir == toClient && level.message.IsResponse() {
+			f.request = c.commands[key]
+			delete(c.commands, key)
+			delete(c.sent, key)
+		}
+	}
+}
+
+// replyError answers request frame with an error response instead of forwarding it to the browser.
+func (c *connection) replyError(f *frame, code int64, message string) error {
+	c.Lock()
+	for _, level := range f.levels {
+		delete(c.commands, commandKey(level.sessionID, level.message.ID))
+		delete(c.sent, commandKey(level.sessionID, level.message.ID))
+	}
+	c.Unlock()
+
+	levels := f.levels
+	if len(levels) == 0 {
+		// frame which could not be decoded is answered with id 0, as the browser does
+		levels = []sessionMessage{{message: &protocolMessage{}}}
+	}
+
+	frames, err := errorReply(levels, code, message)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range frames {
+		if msg, err := decodeMessage(data); err == nil {
+			c.publish(msg)
+		}
+
+		if err := c.client.WriteMessage(f.messageType, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
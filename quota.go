@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const quotaErrorCode = -32000
+
+var byteUnits = map[string]int64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+
+// quota limits resources used by a connection or by all connections of an identity, zero meaning no limit.
+type quota struct {
+	targets  int
+	rps      float64
+	inflight int
+	bytes    int64
+}
+
+func (q *quota) enabled() bool {
+	return q.targets > 0 || q.rps > 0 || q.inflight > 0 || q.bytes > 0
+}
+
+// parseQuota parses limits given as targets=<n>,rps=<n>,inflight=<n>,bytes=<n>[KB|MB|GB].
+func parseQuota(definition string) (*quota, error) {
+	q := &quota{}
+	if definition == "" {
+		return q, nil
+	}
+
+	for _, limit := range strings.Split(definition, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(limit), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid quota %q: expected <limit>=<value>", limit)
+		}
+
+		var err error
+
+		switch name {
+		case "targets":
+			q.targets, err = strconv.Atoi(value)
+		case "rps":
+			q.rps, err = strconv.ParseFloat(value, 64)
+		case "inflight":
+			q.inflight, err = strconv.Atoi(value)
+		case "bytes":
+			q.bytes, err = parseBytes(value)
+		default:
+			err = fmt.Errorf("unknown limit %s", name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota %q: %v", limit, err)
+		}
+	}
+
+	return q, nil
+}
+
+func parseBytes(value string) (int64, error) {
+	value = strings.ToUpper(value)
+	number := strings.TrimRight(value, "KMGB")
+
+	unit, ok := byteUnits[value[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit of %s", value)
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	return size * unit, err
+}
+
+var connectionQuota, identityQuota *quota
+
+// loadQuotas parses -quota and -identity-quota flags.
+func loadQuotas() error {
+	var err error
+
+	if connectionQuota, err = parseQuota(*flagQuota); err != nil {
+		return err
+	}
+
+	identityQuota, err = parseQuota(*flagIdentityQuota)
+	return err
+}
+
+// rateLimiter is a token bucket refilled with rate tokens per second up to rate tokens.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: math.Max(rate, 1), last: time.Now()}
+}
+
+func (r *rateLimiter) allow() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	r.last = now
+
+	// rates below one command per second still allow a command once enough time passed
+	if burst := math.Max(r.rate, 1); r.tokens > burst {
+		r.tokens = burst
+	}
+
+	if r.tokens < 1 {
+		return false
+	}
+
+	r.tokens--
+	return true
+}
+
+// sharedLimiter is rate limiter and transferred bytes of an identity along with number of its connections.
+// Rate limiter is nil if identity quota has no rps limit.
+type sharedLimiter struct {
+	*rateLimiter
+	bytes       atomic.Int64
+	connections int
+	idle        time.Time
+}
+
+// identityLimiters hold usage shared by all connections of an identity. Usage is kept for identityRetention
+// after the last connection of the identity closes so that reconnecting doesn't reset it.
+var identityLimiters = struct {
+	sync.Mutex
+	limiters map[string]*sharedLimiter
+}{limiters: make(map[string]*sharedLimiter)}
+
+const identityRetention = 24 * time.Hour
+
+func identityLimiter(identity string) *sharedLimiter {
+	identityLimiters.Lock()
+	defer identityLimiters.Unlock()
+
+	for other, limiter := range identityLimiters.limiters {
+		if limiter.connections <= 0 && time.Since(limiter.idle) > identityRetention {
+			delete(identityLimiters.limiters, other)
+		}
+	}
+
+	limiter, ok := identityLimiters.limiters[identity]
+	if !ok {
+		limiter = &sharedLimiter{}
+		if identityQuota.rps > 0 {
+			limiter.rateLimiter = newRateLimiter(identityQuota.rps)
+		}
+
+		identityLimiters.limiters[identity] = limiter
+	}
+
+	limiter.connections++
+
+	return limiter
+}
+
+// releaseIdentityLimiter starts retention of identity usage when its last connection is closed.
+func releaseIdentityLimiter(identity string) {
+	identityLimiters.Lock()
+	defer identityLimiters.Unlock()
+
+	if limiter, ok := identityLimiters.limiters[identity]; ok {
+		if limiter.connections--; limiter.connections <= 0 {
+			limiter.idle = time.Now()
+		}
+	}
+}
+
+// quotaEnforcer rejects commands of the client which exceeds its quota or quota of its identity.
+type quotaEnforcer struct {
+	conn            *connection
+	identity        string
+	bytes           atomic.Int64
+	limiter         *rateLimiter
+	identityLimiter *sharedLimiter
+	connectionQuota *quota
+	identityQuota   *quota
+}
+
+// newQuotaEnforcer creates enforcer of configured quotas, returning nil if there are none.
+// Clients which are not authenticated share quota of their address.
+func newQuotaEnforcer(conn *connection) *quotaEnforcer {
+	if !connectionQuota.enabled() && !identityQuota.enabled() {
+		return nil
+	}
+
+	identity := conn.identity
+	if identity == "" {
+		identity, _, _ = net.SplitHostPort(conn.remoteAddr)
+	}
+
+	q := &quotaEnforcer{
+		conn:            conn,
+		identity:        identity,
+		connectionQuota: connectionQuota,
+		identityQuota:   identityQuota,
+	}
+
+	if connectionQuota.rps > 0 {
+		q.limiter = newRateLimiter(connectionQuota.rps)
+	}
+
+	if identityQuota.enabled() {
+		q.identityLimiter = identityLimiter(identity)
+	}
+
+	return q
+}
+
+// release frees resources shared with other connections of the identity once the connection is closed.
+func (q *quotaEnforcer) release() {
+	if q != nil && q.identityLimiter != nil {
+		releaseIdentityLimiter(q.identity)
+	}
+}
+
+func (q *quotaEnforcer) intercept(dir direction, f *frame) (bool, error) {
+	q.bytes.Add(int64(len(f.data)))
+	if q.identityLimiter != nil {
+		q.identityLimiter.bytes.Add(int64(len(f.data)))
+	}
+
+	command := f.message()
+	if dir != toBrowser || command == nil || !command.IsRequest() {
+		return false, nil
+	}
+
+	violation := q.check(command)
+	if violation == "" {
+		return false, nil
+	}
+
+	q.conn.logger.Errorf("quota exceeded: %s rejected in %s: %s", command.Method, q.conn.sessionLabel(f.sessionID()), violation)
+
+	return true, q.conn.replyError(f, quotaErrorCode, "Quota exceeded: "+violation)
+}
+
+// check returns description of exceeded limit or empty string if command is within quota.
+func (q *quotaEnforcer) check(command *protocolMessage) string {
+	peers := q.peers()
+
+	if q.limiter != nil && !q.limiter.allow() {
+		return fmt.Sprintf("more than %g commands per second", q.connectionQuota.rps)
+	}
+
+	if q.identityLimiter != nil && q.identityLimiter.rateLimiter != nil && !q.identityLimiter.allow() {
+		return fmt.Sprintf("more than %g commands per second by %s", q.identityQuota.rps, q.identity)
+	}
+
+	if limit := q.connectionQuota.inflight; limit > 0 && q.conn.pendingCommands("") > limit {
+		return fmt.Sprintf("more than %d commands in flight", limit)
+	}
+
+	if limit := q.identityQuota.inflight; limit > 0 && sum(peers, func(p *quotaEnforcer) int64 { return int64(p.conn.pendingCommands("")) }) > int64(limit) {
+		return fmt.Sprintf("more than %d commands in flight by %s", limit, q.identity)
+	}
+
+	if limit := q.connectionQuota.bytes; limit > 0 && q.bytes.Load() > limit {
+		return fmt.Sprintf("more than %s transferred", formatBytes(float64(limit)))
+	}
+
+	if limit := q.identityQuota.bytes; limit > 0 && q.identityLimiter != nil && q.identityLimiter.bytes.Load() > limit {
+		return fmt.Sprintf("more than %s transferred by %s", formatBytes(float64(limit)), q.identity)
+	}
+
+	if command.Method != "Target.createTarget" {
+		return ""
+	}
+
+	if limit := q.connectionQuota.targets; limit > 0 && q.conn.targets() > limit {
+		return fmt.Sprintf("more than %d targets", limit)
+	}
+
+	if limit := q.identityQuota.targets; limit > 0 && sum(peers, func(p *quotaEnforcer) int64 { return int64(p.conn.targets()) }) > int64(limit) {
+		return fmt.Sprintf("more than %d targets by %s", limit, q.identity)
+	}
+
+	return ""
+}
+
+// peers returns enforcers of active connections sharing identity with the connection, including its own.
+func (q *quotaEnforcer) peers() []*quotaEnforcer {
+	peers := []*quotaEnforcer{q}
+
+	for _, conn := range activeConnections() {
+		conn.Lock()
+		peer := conn.quota
+		conn.Unlock()
+
+		if peer != nil && peer != q && peer.identity == q.identity {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func sum(peers []*quotaEnforcer, value func(*quotaEnforcer) int64) int64 {
+	var total int64
+	for _, peer := range peers {
+		total += value(peer)
+	}
+
+	return total
+}
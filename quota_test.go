@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimiterBelowOnePerSecond(t *testing.T) {
+	limiter := newRateLimiter(0.5)
+
+	if !limiter.allow() {
+		t.Fatal("expected first command to be allowed")
+	}
+
+	if limiter.allow() {
+		t.Fatal("expected second command to be rejected")
+	}
+
+	// two seconds later the limiter has a token again
+	limiter.last = limiter.last.Add(-2 * time.Second)
+
+	if !limiter.allow() {
+		t.Fatal("expected command to be allowed after two seconds")
+	}
+}
+
+func TestIdentityLimiterKeptAfterReconnect(t *testing.T) {
+	previous := identityQuota
+	identityQuota = &quota{rps: 1, bytes: 10}
+	defer func() {
+		identityQuota = previous
+		delete(identityLimiters.limiters, "ci")
+		delete(identityLimiters.limiters, "other")
+	}()
+
+	first, second := identityLimiter("ci"), identityLimiter("ci")
+	if first != second {
+		t.Fatal("expected connections of the same identity to share limiter")
+	}
+
+	first.bytes.Add(20)
+	releaseIdentityLimiter("ci")
+	releaseIdentityLimiter("ci")
+
+	if reconnected := identityLimiter("ci"); reconnected != first || reconnected.bytes.Load() != 20 {
+		t.Fatal("expected usage of the identity to survive reconnect")
+	}
+
+	releaseIdentityLimiter("ci")
+	first.idle = time.Now().Add(-identityRetention - time.Second)
+
+	identityLimiter("other")
+
+	if _, ok := identityLimiters.limiters["ci"]; ok {
+		t.Fatal("expected usage of identity idle for longer than retention to be dropped")
+	}
+}
+
+func TestQuotaRejectsUndecodableCommands(t *testing.T) {
+	conn, client, browser := policyConnection(t)
+	conn.interceptors = []interceptor{&quotaEnforcer{conn: conn, limiter: newRateLimiter(1), connectionQuota: &quota{rps: 1}, identityQuota: &quota{}}}
+
+	for _, data := range []string{`{"id":1.0,"method":"Page.navigate","result":[]}`, `{"id":2,"method":"Page.navigate"}`} {
+		if err := conn.forward(toBrowser, websocket.TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(browser.written) != 1 {
+		t.Fatalf("expected only the first command to fit into quota, got %q", browser.written)
+	}
+
+	if reply := innermostReply(t, client.written); reply.ID != 2 || reply.Error.Code != quotaErrorCode {
+		t.Fatalf("expected second command to exceed quota, got %s", reply.raw)
+	}
+
+	if err := conn.forward(toBrowser, websocket.TextMessage, []byte(`{"id":3,"method":"Page.navigate","id":4}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := innermostReply(t, client.written); reply.ID != 4 || reply.Error.Code != invalidRequestErrorCode {
+		t.Fatalf("expected ambiguous command to be rejected, got %s", reply.raw)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	triggerError     = "error"
+	triggerException = "exception"
+	triggerPending   = "pending"
+	triggerClose     = "close"
+	triggerMatch     = "match"
+	triggerAdmin     = "admin"
+
+	captureTimeFormat = "20060102-150405.000"
+	// defaultCaptureInterval is minimal time between captures of the same trigger, so that routine errors don't flood captures.
+	defaultCaptureInterval = 10 * time.Second
+)
+
+var recorderTriggers = &argumentList{name: "flight-recorder-trigger", values: []string{}}
+
+func init() {
+	flag.Var(recorderTriggers, "flight-recorder-trigger", "dump flight recorder when request/response/event matches pattern")
+}
+
+// recorderLimits bound ring buffer of the flight recorder, zero meaning no limit.
+type recorderLimits struct {
+	frames   int
+	bytes    int64
+	pending  time.Duration
+	interval time.Duration
+}
+
+var flightRecorder *recorderLimits
+
+// loadFlightRecorder parses -flight-recorder given as frames=<n>,bytes=<n>[KB|MB|GB],pending=<duration>,interval=<duration>.
+func loadFlightRecorder() error {
+	if *flagFlightRecorder == "" {
+		return nil
+	}
+
+	limits := &recorderLimits{interval: defaultCaptureInterval}
+
+	for _, limit := range strings.Split(*flagFlightRecorder, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(limit), "=")
+		if !found {
+			return fmt.Errorf("invalid flight recorder limit %q: expected <limit>=<value>", limit)
+		}
+
+		var err error
+
+		switch name {
+		case "frames":
+			limits.frames, err = strconv.Atoi(value)
+		case "bytes":
+			limits.bytes, err = parseBytes(value)
+		case "pending":
+			limits.pending, err = time.ParseDuration(value)
+		case "interval":
+			limits.interval, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown limit %s", name)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid flight recorder limit %q: %v", limit, err)
+		}
+	}
+
+	if limits.frames <= 0 && limits.bytes <= 0 {
+		return fmt.Errorf("invalid flight recorder %q: frames or bytes limit is required", *flagFlightRecorder)
+	}
+
+	flightRecorder = limits
+
+	return nil
+}
+
+// flightRecord is a redacted message kept in the ring buffer.
+type flightRecord struct {
+	Time      time.Time       `json:"time"`
+	From      string          `json:"from"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// recorder keeps the latest messages of the connection in memory and writes them to a capture file when a trigger fires.
+type recorder struct {
+	sync.Mutex
+	conn     *connection
+	limits   *recorderLimits
+	records  []flightRecord
+	bytes    int64
+	pending  map[string]*protocolMessage
+	sent     map[string]time.Time
+	captures int
+	captured map[string]time.Time
+}
+
+func newRecorder(conn *connection) *recorder {
+	return &recorder{
+		conn:     conn,
+		limits:   flightRecorder,
+		pending:  make(map[string]*protocolMessage),
+		sent:     make(map[string]time.Time),
+		captured: make(map[string]time.Time),
+	}
+}
+
+// record adds redacted message to the ring buffer, dumping it if the message fires a trigger.
+func (r *recorder) record(sessionID string, message *protocolMessage) {
+	from := "browser"
+	if message.IsRequest() {
+		from = "client"
+	}
+
+	r.Lock()
+
+	r.records = append(r.records, flightRecord{Time: time.Now(), From: from, SessionID: sessionID, Message: json.RawMessage(message.raw)})
+	r.bytes += int64(len(message.raw))
+
+	for len(r.records) > 0 && (r.limits.frames > 0 && len(r.records) > r.limits.frames || r.limits.bytes > 0 && r.bytes > r.limits.bytes) {
+		r.bytes -= int64(len(r.records[0].Message))
+		r.records = r.records[1:]
+	}
+
+	key := commandKey(sessionID, message.ID)
+	request := r.pending[key]
+
+	if message.IsRequest() {
+		r.pending[key] = message
+		r.sent[key] = time.Now()
+	} else if message.IsResponse() {
+		delete(r.pending, key)
+		delete(r.sent, key)
+	}
+
+	r.Unlock()
+
+	method := message.Method
+	if message.IsResponse() {
+		method = "response to unknown request"
+		if request != nil {
+			method = "response to " + request.Method
+		}
+	}
+
+	switch {
+	case message.IsResponse() && message.IsError():
+		r.dump(triggerError, fmt.Sprintf("%s: %s (%d)", method, message.Error.Message, message.Error.Code))
+
+	case message.Method == "Runtime.exceptionThrown":
+		r.dump(triggerException, "exception thrown in "+r.conn.sessionLabel(sessionID))
+
+	case len(recorderTriggers.values) > 0 && matchesAny(recorderTriggers.values, message.Method+message.raw):
+		r.dump(triggerMatch, method+" matched trigger")
+	}
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(value, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch dumps the ring buffer when request is not answered within pending limit, once per request.
+func (r *recorder) watch(ctxt context.Context) {
+	if r.limits.pending <= 0 {
+		return
+	}
+
+	interval := maxTimeoutCheckInterval
+	if r.limits.pending/4 < interval {
+		interval = r.limits.pending / 4
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var overdue *protocolMessage
+
+			r.Lock()
+			for key, sent := range r.sent {
+				if time.Since(sent) > r.limits.pending {
+					overdue = r.pending[key]
+					delete(r.sent, key)
+					break
+				}
+			}
+			r.Unlock()
+
+			if overdue != nil {
+				r.dump(triggerPending, fmt.Sprintf("%s (id %d) not answered within %s", overdue.Method, overdue.ID, r.limits.pending))
+			}
+
+		case <-ctxt.Done():
+			return
+		}
+	}
+}
+
+// dump writes messages from the ring buffer to a capture file and empties the buffer.
+// Triggers other than admin request are ignored within interval since their last capture, keeping the buffer.
+func (r *recorder) dump(trigger, reason string) (string, error) {
+	r.Lock()
+
+	if last, ok := r.captured[trigger]; ok && trigger != triggerAdmin && time.Since(last) < r.limits.interval {
+		r.Unlock()
+		return "", nil
+	}
+
+	records := r.records
+	r.records, r.bytes = nil, 0
+
+	if len(records) == 0 {
+		r.Unlock()
+		return "", nil
+	}
+
+	r.captures++
+	r.captured[trigger] = time.Now()
+	captures := r.captures
+	r.Unlock()
+
+	path := filepath.Join(*flagDirLogs, "captures", r.conn.id, fmt.Sprintf("%s-%03d-%s.jsonl", time.Now().Format(captureTimeFormat), captures, trigger))
+
+	err := writeCapture(path, r.conn, trigger, reason, records)
+	r.conn.logArtifact("flight recorder capture ("+reason+")", "", path, err)
+
+	return path, err
+}
+
+func writeCapture(path string, conn *connection, trigger, reason string, records []flightRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+
+	header := map[string]interface{}{
+		"connection": conn.id,
+		"remoteAddr": conn.remoteAddr,
+		"label":      conn.label,
+		"trigger":    trigger,
+		"reason":     reason,
+		"time":       time.Now(),
+		"frames":     len(records),
+	}
+
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	return file.Close()
+}
+
+// flightRecorderHandler dumps flight recorders of all active connections (or only the one given by id or label).
+// Dump empties the recorders, so it has to be requested with POST.
+func flightRecorderHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.Header().Set("Allow", http.MethodPost)
+		http.Error(res, "flight recorder is dumped with POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if flightRecorder == nil {
+		http.Error(res, "flight recorder is disabled, run proxy with -flight-recorder", http.StatusNotFound)
+		return
+	}
+
+	id, label := req.URL.Query().Get("id"), req.URL.Query().Get("label")
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, conn := range activeConnections() {
+		if id != "" && conn.id != id || label != "" && conn.label != label {
+			continue
+		}
+
+		path, err := conn.recorder.dump(triggerAdmin, "requested by "+req.RemoteAddr)
+
+		switch {
+		case err != nil:
+			fmt.Fprintf(res, "connection %s from %s: could not write capture: %v\n", conn.id, conn.remoteAddr, err)
+		case path == "":
+			fmt.Fprintf(res, "connection %s from %s: no frames recorded\n", conn.id, conn.remoteAddr)
+		default:
+			fmt.Fprintf(res, "connection %s from %s: %s\n", conn.id, conn.remoteAddr, path)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecorderLimitsCapturesPerTrigger(t *testing.T) {
+	dir := *flagDirLogs
+	*flagDirLogs = t.TempDir()
+	defer func() { *flagDirLogs = dir }()
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	conn := newConnection("test", "127.0.0.1:1", logrus.NewEntry(logger))
+	r := newRecorder(conn)
+	r.limits = &recorderLimits{interval: time.Hour}
+
+	event := &protocolMessage{Method: "Page.loadEventFired", raw: `{"method":"Page.loadEventFired"}`}
+
+	r.record("", event)
+	if path, err := r.dump(triggerError, "first"); err != nil || path == "" {
+		t.Fatalf("expected first capture to be written, got %q, %v", path, err)
+	}
+
+	r.record("", event)
+	if path, _ := r.dump(triggerError, "second"); path != "" {
+		t.Fatalf("expected capture of the same trigger within interval to be skipped, got %s", path)
+	}
+
+	if path, _ := r.dump(triggerException, "other"); path == "" {
+		t.Fatal("expected other trigger to be captured with frames kept from the skipped one")
+	}
+
+	r.record("", event)
+	if path, _ := r.dump(triggerAdmin, "requested"); path == "" {
+		t.Fatal("expected admin request to be captured regardless of interval")
+	}
+}
+
+func TestFlightRecorderRequiresPost(t *testing.T) {
+	res := httptest.NewRecorder()
+	flightRecorderHandler(res, httptest.NewRequest(http.MethodGet, "/cpp/flight-recorder", nil))
+
+	if res.Code != http.StatusMethodNotAllowed || res.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("expected GET to be rejected, got %d with Allow %q", res.Code, res.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "[REDACTED]"
+
+var defaultRedactions = []string{
+	"Network.getCookies:result.cookies[*].value",
+	"Network.getAllCookies:result.cookies[*].value",
+	"Storage.getCookies:result.cookies[*].value",
+	"Network.setCookie:params.value",
+	"Network.setCookies:params.cookies[*].value",
+	"Storage.setCookies:params.cookies[*].value",
+	"Network.requestWillBeSentExtraInfo:params.associatedCookies[*].cookie.value",
+	"Network.responseReceivedExtraInfo:params.headersText",
+	"Input.insertText:params.text",
+	"Input.imeSetComposition:params.text",
+	"Input.dispatchKeyEvent:params.text",
+	"Input.dispatchKeyEvent:params.unmodifiedText",
+	"Input.dispatchKeyEvent:params.key",
+	"Input.dispatchKeyEvent:params.code",
+	"header:Authorization",
+	"header:Proxy-Authorization",
+	"header:Cookie",
+	"header:Set-Cookie",
+}
+
+type redactionRule struct {
+	method  string
+	path    []string
+	header  string
+	pattern *regexp.Regexp
+}
+
+var redactRules = &argumentList{name: "redact", values: []string{}}
+
+var redactions []*redactionRule
+
+func init() {
+	flag.Var(redactRules, "redact", "redact values before they are logged: <method>:<json path>, header:<name> or regex:<pattern>")
+}
+
+// parseRedactions builds redaction rules from flags, including default ones unless disabled.
+func parseRedactions() error {
+	definitions := redactRules.values
+	if !*flagNoDefaultRedactions {
+		definitions = append(append([]string{}, defaultRedactions...), definitions...)
+	}
+
+	for _, definition := range definitions {
+		rule, err := parseRedactionRule(definition)
+		if err != nil {
+			return err
+		}
+
+		redactions = append(redactions, rule)
+	}
+
+	return nil
+}
+
+func parseRedactionRule(definition string) (*redactionRule, error) {
+	kind, value, found := strings.Cut(definition, ":")
+	if !found || value == "" {
+		return nil, fmt.Errorf("invalid redaction rule %q", definition)
+	}
+
+	switch kind {
+	case "header":
+		return &redactionRule{header: strings.ToLower(value)}, nil
+	case "regex":
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction rule %q: %v", definition, err)
+		}
+
+		return &redactionRule{pattern: pattern}, nil
+	}
+
+	if !strings.HasPrefix(value, "params.") && !strings.HasPrefix(value, "result.") {
+		return nil, fmt.Errorf("invalid redaction rule %q: path must start with params. or result.", definition)
+	}
+
+	return &redactionRule{method: kind, path: strings.Split(value, ".")}, nil
+}
+
+// redact replaces sensitive values in message sent, received or replied to method and reports whether anything was replaced.
+func redact(method string, message *protocolMessage) bool {
+	redacted := false
+
+	for _, rule := range redactions {
+		switch {
+		case rule.pattern != nil:
+			redacted = redactPattern(rule.pattern, message.Params) || redacted
+			redacted = redactPattern(rule.pattern, message.Result) || redacted
+
+			if rule.pattern.MatchString(message.Error.Message) || rule.pattern.MatchString(message.Error.Data) {
+				message.Error.Message = rule.pattern.ReplaceAllString(message.Error.Message, redactedValue)
+				message.Error.Data = rule.pattern.ReplaceAllString(message.Error.Data, redactedValue)
+				redacted = true
+			}
+
+		case rule.header != "":
+			redacted = redactHeader(rule.header, message.Params) || redacted
+			redacted = redactHeader(rule.header, message.Result) || redacted
+
+		case matchMethod(rule.method, method):
+			values := message.Params
+			if rule.path[0] == "result" {
+				values = message.Result
+			}
+
+			redacted = redactPath(rule.path[1:], values) || redacted
+		}
+	}
+
+	if redacted {
+		if raw, err := json.Marshal(message); err == nil {
+			message.raw = string(raw)
+		}
+	}
+
+	return redacted
+}
+
+// redactText applies regex rules to free-form text.
+func redactText(text string) string {
+	for _, rule := range redactions {
+		if rule.pattern != nil {
+			text = rule.pattern.ReplaceAllString(text, redactedValue)
+		}
+	}
+
+	return text
+}
+
+// matchMethod reports whether method matches pattern, which can be exact method, `Domain.*` or `*`.
+func matchMethod(pattern, method string) bool {
+	if pattern == "*" || pattern == method {
+		return true
+	}
+
+	return strings.HasSuffix(pattern, "*") && strings.HasPrefix(method, strings.TrimSuffix(pattern, "*"))
+}
+
+func redactPath(path []string, value interface{}) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	key := path[0]
+	wildcard := strings.HasSuffix(key, "[*]")
+	key = strings.TrimSuffix(key, "[*]")
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	var children []interface{}
+	redacted := false
+
+	for name, child := range object {
+		if key != "*" && name != key {
+			continue
+		}
+
+		if len(path) == 1 && !wildcard {
+			object[name] = redactedValue
+			redacted = true
+			continue
+		}
+
+		if items, ok := child.([]interface{}); ok && wildcard {
+			if len(path) == 1 {
+				for i := range items {
+					items[i] = redactedValue
+					redacted = true
+				}
+
+				continue
+			}
+
+			children = append(children, items...)
+		} else {
+			children = append(children, child)
+		}
+	}
+
+	for _, child := range children {
+		redacted = redactPath(path[1:], child) || redacted
+	}
+
+	return redacted
+}
+
+func redactHeader(header string, value interface{}) bool {
+	redacted := false
+
+	switch values := value.(type) {
+	case map[string]interface{}:
+		for key, child := range values {
+			if headers, ok := child.(map[string]interface{}); ok && strings.HasSuffix(strings.ToLower(key), "headers") {
+				for name := range headers {
+					if strings.ToLower(name) == header {
+						headers[name] = redactedValue
+						redacted = true
+					}
+				}
+			}
+
+			if strings.ToLower(asString(values["name"])) == header && key == "value" {
+				values[key] = redactedValue
+				redacted = true
+				continue
+			}
+
+			redacted = redactHeader(header, child) || redacted
+		}
+
+	case []interface{}:
+		for _, child := range values {
+			redacted = redactHeader(header, child) || redacted
+		}
+	}
+
+	return redacted
+}
+
+func redactPattern(pattern *regexp.Regexp, value interface{}) bool {
+	redacted := false
+
+	switch values := value.(type) {
+	case map[string]interface{}:
+		for key, child := range values {
+			if text, ok := child.(string); ok && pattern.MatchString(text) {
+				values[key] = pattern.ReplaceAllString(text, redactedValue)
+				redacted = true
+			} else {
+				redacted = redactPattern(pattern, child) || redacted
+			}
+		}
+
+	case []interface{}:
+		for i, child := range values {
+			if text, ok := child.(string); ok && pattern.MatchString(text) {
+				values[i] = pattern.ReplaceAllString(text, redactedValue)
+				redacted = true
+			} else {
+				redacted = redactPattern(pattern, child) || redacted
+			}
+		}
+	}
+
+	return redacted
+}
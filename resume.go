@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	resumeQueryParam = "cpp-resume"
+	resumeHeader     = "X-CDP-Proxy-Resume"
+	// resumeBufferSize limits messages buffered for the client which did not resume yet.
+	resumeBufferSize = 64 * 1024 * 1024
+)
+
+var errResumeBufferFull = errors.New("buffer of messages waiting for the client to resume is full")
+
+// bufferedMessage is a message written to the client while it was disconnected.
+type bufferedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// suspend makes writer buffer messages until the client resumes the connection.
+func (w *wsWriter) suspend() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.suspended = true
+}
+
+// buffer keeps message for the client which is disconnected, failing when there are too many of them.
+func (w *wsWriter) buffer(messageType int, data []byte) error {
+	if w.bufferedSize+len(data) > resumeBufferSize {
+		return errResumeBufferFull
+	}
+
+	w.buffered = append(w.buffered, bufferedMessage{messageType: messageType, data: data})
+	w.bufferedSize += len(data)
+
+	return nil
+}
+
+// resume replaces connection of the client, closing the previous one, and writes buffered messages to it.
+// It returns number of written messages, the rest stays buffered if the new connection fails too.
+func (w *wsWriter) resume(conn messageConn) int {
+	w.Lock()
+	defer w.Unlock()
+
+	w.conn.Close()
+	w.conn = conn
+	w.suspended = false
+
+	for i, msg := range w.buffered {
+		if err := conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			w.suspended = true
+			w.buffered = w.buffered[i:]
+
+			w.bufferedSize = 0
+			for _, msg := range w.buffered {
+				w.bufferedSize += len(msg.data)
+			}
+
+			return i
+		}
+	}
+
+	written := len(w.buffered)
+	w.buffered, w.bufferedSize = nil, 0
+
+	return written
+}
+
+// relay proxies messages of the client until either side of the connection goes away and returns the error
+// which ended it along with direction of messages read from the side which failed (no error if the proxy shuts down).
+// With -resume-grace the browser connection is kept open for the client which disconnected, so that it can resume.
+func (c *connection) relay(ctxt context.Context, in messageConn, errc chan error) (direction, error) {
+	for {
+		clientErrc := make(chan error, 1)
+		go c.proxy(ctxt, toBrowser, in, clientErrc)
+
+		select {
+		case err := <-errc:
+			return toClient, err
+
+		case err := <-c.expired:
+			return toClient, err
+
+		case <-ctxt.Done():
+			return toBrowser, nil
+
+		case err := <-clientErrc:
+			// client which sent close frame went away on purpose, abnormal closure means the connection dropped
+			var closed *websocket.CloseError
+			if *flagResumeGrace == 0 || errors.As(err, &closed) && closed.Code != websocket.CloseAbnormalClosure {
+				return toBrowser, err
+			}
+
+			c.client.suspend()
+			c.logger.Infof("client disconnected (%v), waiting %s for it to resume", err, *flagResumeGrace)
+
+			timer := time.NewTimer(*flagResumeGrace)
+
+			select {
+			case in = <-c.resumes:
+				timer.Stop()
+
+			case err := <-errc:
+				timer.Stop()
+				return toClient, err
+
+			case err := <-c.expired:
+				timer.Stop()
+				return toClient, err
+
+			case <-ctxt.Done():
+				timer.Stop()
+				return toBrowser, nil
+
+			case <-timer.C:
+				c.logger.Infof("client did not resume within %s", *flagResumeGrace)
+				return toBrowser, err
+			}
+
+		case in = <-c.resumes:
+			c.logger.Infof("client connection was taken over by resumed one")
+		}
+
+		c.watchClient(in)
+
+		written := c.client.resume(in)
+		c.logger.Infof("client resumed connection, %d buffered messages sent", written)
+	}
+}
+
+// resumable holds connections which can be resumed by their token.
+var resumable = struct {
+	sync.Mutex
+	connections map[string]*connection
+}{connections: make(map[string]*connection)}
+
+// registerResumable makes connection resumable with randomly generated token.
+func registerResumable(conn *connection) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+
+	token := hex.EncodeToString(random)
+
+	resumable.Lock()
+	defer resumable.Unlock()
+
+	conn.resumeToken = token
+	resumable.connections[token] = conn
+
+	return nil
+}
+
+// unregisterResumable forgets the connection once it is closed so that it can't be resumed anymore.
+func unregisterResumable(conn *connection) {
+	resumable.Lock()
+	defer resumable.Unlock()
+
+	if resumable.connections[conn.resumeToken] == conn {
+		delete(resumable.connections, conn.resumeToken)
+	}
+
+	close(conn.ended)
+}
+
+func resumableConnection(token string) *connection {
+	resumable.Lock()
+	defer resumable.Unlock()
+
+	return resumable.connections[token]
+}
+
+// resumeToken returns token of the connection which the client wants to resume.
+func resumeToken(req *http.Request) string {
+	if token := req.URL.Query().Get(resumeQueryParam); token != "" {
+		return token
+	}
+
+	return req.Header.Get(resumeHeader)
+}
+
+// resumeConnection hands websocket of the client over to the connection it resumes.
+func resumeConnection(conn *connection, res http.ResponseWriter, req *http.Request) {
+	if identityFrom(req) != conn.identity {
+		conn.logger.Errorf("could not resume connection from %s: identity does not match", req.RemoteAddr)
+		http.Error(res, "connection belongs to another identity", http.StatusForbidden)
+		return
+	}
+
+	in, err := wsUpgrader.Upgrade(res, req, http.Header{resumeHeader: {conn.resumeToken}})
+	if err != nil {
+		conn.logger.Errorf("could not upgrade websocket from %s: %v", req.RemoteAddr, err)
+		return
+	}
+
+	conn.logger.Infof("---------- resuming connection from %s to %s ----------", req.RemoteAddr, req.URL.Path)
+
+	select {
+	case conn.resumes <- in:
+	case <-conn.ended:
+		in.Close()
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	// retentionCheckInterval is how often log files are checked against -log-retention.
+	retentionCheckInterval = time.Minute
+)
+
+// rotationLimits describe when log files are rotated and how rotated files are compressed, zero meaning no limit.
+type rotationLimits struct {
+	size        int64
+	interval    time.Duration
+	compression string
+}
+
+// retentionLimits describe which log files are deleted, zero meaning no limit.
+type retentionLimits struct {
+	age  time.Duration
+	size int64
+}
+
+var (
+	logRotation  *rotationLimits
+	logRetention *retentionLimits
+	// compressions tracks compression of rotated files which needs to finish before exit.
+	compressions sync.WaitGroup
+)
+
+// loadLogRotation parses -log-rotate given as size=<n>[KB|MB|GB],interval=<duration>,compress=gzip|zstd
+// and -log-retention given as age=<duration>,size=<n>[KB|MB|GB].
+func loadLogRotation() error {
+	if *flagLogRotate != "" {
+		limits := &rotationLimits{}
+
+		err := parseLimits(*flagLogRotate, func(name, value string) (err error) {
+			switch name {
+			case "size":
+				limits.size, err = parseBytes(value)
+			case "interval":
+				limits.interval, err = time.ParseDuration(value)
+			case "compress":
+				if value != compressionGzip && value != compressionZstd {
+					return fmt.Errorf("unsupported compression %s, expected %s or %s", value, compressionGzip, compressionZstd)
+				}
+				limits.compression = value
+			default:
+				err = fmt.Errorf("unknown limit %s", name)
+			}
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("invalid -log-rotate: %v", err)
+		}
+
+		if limits.size <= 0 && limits.interval <= 0 {
+			return fmt.Errorf("invalid -log-rotate %q: size or interval is required", *flagLogRotate)
+		}
+
+		logRotation = limits
+	}
+
+	if *flagLogRetention != "" {
+		limits := &retentionLimits{}
+
+		err := parseLimits(*flagLogRetention, func(name, value string) (err error) {
+			switch name {
+			case "age":
+				limits.age, err = time.ParseDuration(value)
+			case "size":
+				limits.size, err = parseBytes(value)
+			default:
+				err = fmt.Errorf("unknown limit %s", name)
+			}
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("invalid -log-retention: %v", err)
+		}
+
+		if limits.age <= 0 && limits.size <= 0 {
+			return fmt.Errorf("invalid -log-retention %q: age or size is required", *flagLogRetention)
+		}
+
+		logRetention = limits
+	}
+
+	return nil
+}
+
+func parseLimits(value string, parse func(name, value string) error) error {
+	for _, limit := range strings.Split(value, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(limit), "=")
+		if !found {
+			return fmt.Errorf("invalid limit %q: expected <limit>=<value>", limit)
+		}
+
+		if err := parse(name, value); err != nil {
+			return fmt.Errorf("invalid limit %q: %v", limit, err)
+		}
+	}
+
+	return nil
+}
+
+// openLogFiles counts handles of log files which are being written or compressed and can't be deleted by retention.
+var openLogFiles = struct {
+	sync.Mutex
+	paths map[string]int
+}{paths: make(map[string]int)}
+
+func holdLogFile(path string) {
+	openLogFiles.Lock()
+	defer openLogFiles.Unlock()
+
+	openLogFiles.paths[filepath.Clean(path)]++
+}
+
+func releaseLogFile(path string) {
+	openLogFiles.Lock()
+	defer openLogFiles.Unlock()
+
+	path = filepath.Clean(path)
+
+	if openLogFiles.paths[path]--; openLogFiles.paths[path] <= 0 {
+		delete(openLogFiles.paths, path)
+	}
+}
+
+// rotatingFile is a log file which is renamed (and compressed) once it reaches -log-rotate size or age
+// and replaced with an empty one.
+type rotatingFile struct {
+	sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	holdLogFile(path)
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.size > 0 && logRotation != nil && (logRotation.size > 0 && f.size+int64(len(p)) > logRotation.size || logRotation.interval > 0 && time.Since(f.opened) > logRotation.interval) {
+		if err := f.rotate(); err != nil {
+			log.Printf("could not rotate %s: %v", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// rotate renames current file to <name>.log.<time>, compresses it in background and opens empty file in its place.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	compression := logRotation.compression
+	rotated := f.path + "." + time.Now().Format(captureTimeFormat)
+
+	// file rotated within the same millisecond must not be replaced, compressed copy exists before it's removed
+	for n := 1; fileExists(rotated) || fileExists(rotated+compressionSuffix(compression)); n++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, time.Now().Format(captureTimeFormat), n)
+	}
+
+	// rotated file and its compressed copy are held until compression finishes so that retention doesn't delete them
+	compressed := rotated + compressionSuffix(compression)
+	if compression != "" {
+		holdLogFile(rotated)
+		holdLogFile(compressed)
+	}
+
+	renamed := os.Rename(f.path, rotated)
+	if renamed != nil && compression != "" {
+		releaseLogFile(rotated)
+		releaseLogFile(compressed)
+	}
+
+	// file is reopened even if it could not be renamed so that logging goes on
+	if err := f.open(); err != nil {
+		f.file = nil
+		return err
+	}
+
+	if renamed != nil {
+		return renamed
+	}
+
+	// index is updated in background as it may be locked by whoever is writing this log
+	compressions.Add(1)
+	go func() {
+		defer compressions.Done()
+
+		indexRotatedFile(f.path, rotated, false)
+
+		if compression == "" {
+			return
+		}
+
+		defer releaseLogFile(rotated)
+		defer releaseLogFile(compressed)
+
+		if err := compressFile(rotated, compression); err != nil {
+			log.Printf("could not compress %s: %v", rotated, err)
+			return
+		}
+
+		indexRotatedFile(rotated, compressed, true)
+	}()
+
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		releaseLogFile(f.path)
+	}
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressionSuffix returns extension of files compressed with given compression.
+func compressionSuffix(compression string) string {
+	switch compression {
+	case compressionGzip:
+		return ".gz"
+	case compressionZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// compressFile replaces file with its copy compressed with gzip or zstd.
+func compressFile(path, compression string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.Create(path + compressionSuffix(compression))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if compression == compressionZstd {
+		err = zstdCompress(target, source)
+	} else {
+		writer := gzip.NewWriter(target)
+		if _, err = io.Copy(writer, source); err == nil {
+			err = writer.Close()
+		}
+	}
+
+	if err == nil {
+		err = target.Close()
+	}
+
+	if err != nil {
+		os.Remove(target.Name())
+		return err
+	}
+
+	source.Close()
+
+	return os.Remove(path)
+}
+
+// indexRotatedFile lists rotated or compressed copy of the log file for connections which wrote it.
+func indexRotatedFile(path, copy string, replace bool) {
+	if !indexEnabled() {
+		return
+	}
+
+	if err := indexFileCopy(path, copy, replace); err != nil {
+		log.Printf("could not update %s: %v", indexFileName, err)
+	}
+}
+
+// watchRetention deletes log files exceeding -log-retention on start and then periodically.
+func watchRetention(logger *logrus.Entry) {
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		deleted := enforceRetention()
+		for _, path := range deleted {
+			logger.Infof("deleted log file %s", path)
+		}
+
+		if len(deleted) > 0 && indexEnabled() {
+			if err := forgetIndexedFiles(deleted); err != nil {
+				logger.Errorf("could not update %s: %v", indexFileName, err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// enforceRetention deletes log files older than -log-retention age and the oldest ones while all log files
+// take more than -log-retention size. Files which are being written are never deleted.
+func enforceRetention() []string {
+	type logFile struct {
+		path     string
+		size     int64
+		modified time.Time
+	}
+
+	var files []logFile
+	var total int64
+
+	filepath.WalkDir(*flagDirLogs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !isLogFile(entry.Name()) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		total += info.Size()
+
+		openLogFiles.Lock()
+		open := openLogFiles.paths[path] > 0
+		openLogFiles.Unlock()
+
+		if !open {
+			files = append(files, logFile{path: path, size: info.Size(), modified: info.ModTime()})
+		}
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modified.Before(files[j].modified)
+	})
+
+	var deleted []string
+
+	for _, file := range files {
+		expired := logRetention.age > 0 && time.Since(file.modified) > logRetention.age
+		if !expired && (logRetention.size <= 0 || total <= logRetention.size) {
+			continue
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("could not delete %s: %v", file.path, err)
+			continue
+		}
+
+		total -= file.size
+		deleted = append(deleted, file.path)
+	}
+
+	return deleted
+}
+
+// isLogFile reports whether file was written by a logger, either as current or rotated log.
+func isLogFile(name string) bool {
+	return strings.HasSuffix(name, ".log") || strings.Contains(name, ".log.")
+}
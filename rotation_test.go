@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRetentionSkipsHeldLogFiles(t *testing.T) {
+	dir, retention := *flagDirLogs, logRetention
+	*flagDirLogs = t.TempDir()
+	logRetention = &retentionLimits{age: time.Nanosecond}
+	defer func() { *flagDirLogs, logRetention = dir, retention }()
+
+	path := filepath.Join(*flagDirLogs, "shared.log")
+
+	first, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated file waiting for compression
+	rotated := path + ".20260101-000000.000"
+	if err := os.WriteFile(rotated, []byte("rotated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	holdLogFile(rotated)
+
+	first.Close()
+	first.Close()
+	time.Sleep(time.Millisecond)
+
+	if deleted := enforceRetention(); len(deleted) != 0 {
+		t.Fatalf("expected files still open or compressed to be kept, deleted %v", deleted)
+	}
+
+	second.Close()
+	releaseLogFile(rotated)
+
+	if deleted := enforceRetention(); len(deleted) != 2 {
+		t.Fatalf("expected released files to be deleted, deleted %v", deleted)
+	}
+}
+
+func TestRotatedFilesIndexed(t *testing.T) {
+	dir := resetIndex(t)
+
+	distribute, rotation := *flagDistributeLogs, logRotation
+	*flagDistributeLogs = true
+	logRotation = &rotationLimits{size: 10, compression: compressionZstd}
+	defer func() { *flagDistributeLogs, logRotation = distribute, rotation }()
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	conn := newConnection("test", "127.0.0.1:1", logrus.NewEntry(logger))
+
+	path := filepath.Join(dir, "test.log")
+	conn.wrote(path)
+
+	if err := updateIndex(conn, false); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Write([]byte("first line\n"))
+	file.Write([]byte("second line\n"))
+	file.Close()
+	compressions.Wait()
+
+	if err := updateIndex(conn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	files := index.connections[0].Files
+	if len(files) != 2 || files[0] != path || !strings.HasPrefix(files[1], path+".") || !strings.HasSuffix(files[1], ".zst") {
+		t.Fatalf("expected log file and its compressed rotated copy to be indexed, got %v", files)
+	}
+
+	if _, err := os.Stat(files[1]); err != nil {
+		t.Fatal(err)
+	}
+}
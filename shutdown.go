@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const shutdownCloseReason = "proxy is shutting down"
+
+var (
+	// connectionsContext is cancelled when proxied connections should be closed on shutdown.
+	connectionsContext, closeConnections = context.WithCancel(context.Background())
+	shutdownRequests                     = make(chan string, 1)
+	// handlers and streams track connection handlers and dumpStream goroutines which need to finish before exit.
+	handlers sync.WaitGroup
+	streams  sync.WaitGroup
+	started  = time.Now()
+)
+
+// requestShutdown starts graceful shutdown unless it was already requested.
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default:
+	}
+}
+
+// handleSignals requests graceful shutdown on interrupt or termination and exits immediately when signalled again.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	requestShutdown(sig.String())
+
+	<-signals
+	os.Exit(1)
+}
+
+// shutdown stops accepting connections, closes proxied ones letting their streams drain,
+// stops launched browser, writes summary, waits for rotated logs to be compressed and closes all loggers.
+func shutdown(reason string, server *http.Server, browser *browserProcess, logger *logrus.Entry) {
+	logger.Infof("---------- shutting down (%s) ----------", reason)
+
+	ctxt, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctxt); err != nil {
+		logger.Errorf("could not stop accepting connections: %v", err)
+	}
+
+	closeConnections()
+
+	if !wait(ctxt, &handlers) || !wait(ctxt, &streams) {
+		logger.Errorf("connections were not closed within %s", *flagShutdownTimeout)
+	}
+
+	if browser != nil {
+		browser.stop()
+	}
+
+	if err := writeSummary(logger); err != nil {
+		logger.Errorf("could not write summary: %v", err)
+	}
+
+	if !wait(ctxt, &compressions) {
+		logger.Errorf("rotated log files were not compressed within %s", *flagShutdownTimeout)
+	}
+
+	closeLoggers()
+}
+
+// wait waits for the group until context is done and reports whether it finished.
+func wait(ctxt context.Context, group *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctxt.Done():
+		return false
+	}
+}
+
+// connectionSummary describes connection closed since the proxy started.
+type connectionSummary struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Identity   string    `json:"identity,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	Messages   int64     `json:"messages"`
+	Errors     int64     `json:"errors"`
+}
+
+// maxSummaryConnections bounds connections listed by the summary, the latest ones are kept.
+const maxSummaryConnections = 1000
+
+// served counts all closed connections and keeps the latest of them.
+var served = struct {
+	sync.Mutex
+	count       int64
+	messages    int64
+	errors      int64
+	connections []connectionSummary
+}{}
+
+// recordConnection counts closed connection and remembers it so that it is included in the summary.
+func recordConnection(conn *connection) {
+	served.Lock()
+	defer served.Unlock()
+
+	served.count++
+	served.messages += conn.messages.Load()
+	served.errors += conn.errors.Load()
+
+	if len(served.connections) >= maxSummaryConnections {
+		served.connections = append(served.connections[:0], served.connections[1:]...)
+	}
+
+	served.connections = append(served.connections, connectionSummary{
+		ID:         conn.id,
+		RemoteAddr: conn.remoteAddr,
+		Identity:   conn.identity,
+		Label:      conn.label,
+		Started:    conn.started,
+		Ended:      time.Now(),
+		Messages:   conn.messages.Load(),
+		Errors:     conn.errors.Load(),
+	})
+}
+
+// writeSummary logs summary of connections served since the proxy started and writes it to summary.json in logs directory.
+func writeSummary(logger *logrus.Entry) error {
+	served.Lock()
+	defer served.Unlock()
+
+	for _, conn := range served.connections {
+		logger.Infof("connection %s from %s: %s, %d messages, %d errors", conn.ID, conn.RemoteAddr, conn.Ended.Sub(conn.Started).Round(time.Millisecond), conn.Messages, conn.Errors)
+	}
+
+	uptime := time.Since(started)
+	logger.Infof("served %d connections in %s: %d messages, %d errors", served.count, uptime.Round(time.Millisecond), served.messages, served.errors)
+
+	summary := struct {
+		Started     time.Time           `json:"started"`
+		Stopped     time.Time           `json:"stopped"`
+		Served      int64               `json:"served"`
+		Connections []connectionSummary `json:"connections"`
+		Messages    int64               `json:"messages"`
+		Errors      int64               `json:"errors"`
+	}{started, time.Now(), served.count, served.connections, served.messages, served.errors}
+
+	if summary.Connections == nil {
+		summary.Connections = []connectionSummary{}
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*flagDirLogs, os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(*flagDirLogs, "summary.json"), data, 0644)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const labelLength = 32
+
+type targetInfo struct {
+	ID        string
+	Type      string
+	URL       string
+	Title     string
+	OpenerID  string
+	Ordinal   int
+	Destroyed bool
+}
+
+func (t *targetInfo) label() string {
+	name := fmt.Sprintf("%s#%d", t.Type, t.Ordinal)
+
+	if location := shortURL(t.URL); location != "" {
+		return name + " " + location
+	}
+
+	if t.Title != "" {
+		return name + " " + t.Title
+	}
+
+	return name
+}
+
+type targetRegistry struct {
+	sync.Mutex
+	targets  map[string]*targetInfo
+	sessions map[string]string
+	parents  map[string]string
+	ordinals map[string]int
+	order    []string
+}
+
+func newTargetRegistry() *targetRegistry {
+	return &targetRegistry{
+		targets:  make(map[string]*targetInfo),
+		sessions: make(map[string]string),
+		parents:  make(map[string]string),
+		ordinals: make(map[string]int),
+	}
+}
+
+// observe updates registry with Target domain events describing targets and sessions
+// received on given session (or on the browser session if empty).
+func (r *targetRegistry) observe(msg *protocolMessage, parentID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	switch msg.Method {
+	case "Target.targetCreated", "Target.targetInfoChanged":
+		r.update(msg.Params["targetInfo"])
+
+	case "Target.attachedToTarget":
+		if target := r.update(msg.Params["targetInfo"]); target != nil {
+			sessionID := asString(msg.Params["sessionId"])
+			if _, exists := r.sessions[sessionID]; !exists {
+				r.order = append(r.order, sessionID)
+			}
+			r.sessions[sessionID] = target.ID
+
+			if parentID != "" && parentID != sessionID {
+				r.parents[sessionID] = parentID
+			}
+		}
+
+	case "Target.detachedFromTarget":
+		sessionID := asString(msg.Params["sessionId"])
+		if targetID, ok := msg.Params["targetId"].(string); ok {
+			if _, exists := r.sessions[sessionID]; !exists {
+				r.order = append(r.order, sessionID)
+				r.sessions[sessionID] = targetID
+			}
+		}
+
+	case "Target.targetDestroyed":
+		if target, exists := r.targets[asString(msg.Params["targetId"])]; exists {
+			target.Destroyed = true
+		}
+	}
+}
+
+func (r *targetRegistry) update(value interface{}) *targetInfo {
+	info, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	targetID := asString(info["targetId"])
+	target, exists := r.targets[targetID]
+	if !exists {
+		target = &targetInfo{ID: targetID, Type: asString(info["type"])}
+		r.ordinals[target.Type]++
+		target.Ordinal = r.ordinals[target.Type]
+		r.targets[targetID] = target
+	}
+
+	if val, ok := info["url"].(string); ok {
+		target.URL = val
+	}
+
+	if val, ok := info["title"].(string); ok {
+		target.Title = val
+	}
+
+	if val, ok := info["openerId"].(string); ok {
+		target.OpenerID = val
+	}
+
+	return target
+}
+
+// label returns short, human-readable label for given session id or session id itself when target is unknown.
+func (r *targetRegistry) label(sessionID string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if target, exists := r.targets[r.sessions[sessionID]]; exists {
+		return fit(target.label(), labelLength)
+	}
+
+	return sessionID
+}
+
+// nest records that session was reached through parent session if it is not known already.
+func (r *targetRegistry) nest(parentID, sessionID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.parents[sessionID]; !exists && parentID != "" && parentID != sessionID {
+		r.parents[sessionID] = parentID
+	}
+}
+
+// path returns labels of all sessions leading to given session, i.e. `page#1 example.com > worker#2`.
+func (r *targetRegistry) path(sessionID string) string {
+	var labels []string
+	visited := make(map[string]bool)
+
+	for id := sessionID; id != "" && !visited[id]; id = r.parent(id) {
+		visited[id] = true
+		labels = append([]string{r.label(id)}, labels...)
+	}
+
+	if len(labels) == 1 {
+		return labels[0]
+	}
+
+	path := strings.Join(labels, " > ")
+	if len(path) > labelLength {
+		return "..." + truncateLeft(path, labelLength-3)
+	}
+
+	return path
+}
+
+func (r *targetRegistry) parent(sessionID string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.parents[sessionID]
+}
+
+// mapping describes every known session and target in a stable order.
+func (r *targetRegistry) mapping() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var lines []string
+
+	for _, sessionID := range r.order {
+		target := r.targets[r.sessions[sessionID]]
+		line := fmt.Sprintf("session %s => %s", sessionID, r.describe(target))
+
+		if parentID, exists := r.parents[sessionID]; exists {
+			line += " via session " + parentID
+		}
+
+		lines = append(lines, line)
+	}
+
+	var detached []string
+	for targetID, target := range r.targets {
+		if !r.hasSession(targetID) {
+			detached = append(detached, fmt.Sprintf("target %s => %s", targetID, r.describe(target)))
+		}
+	}
+
+	sort.Strings(detached)
+
+	return append(lines, detached...)
+}
+
+func (r *targetRegistry) hasSession(targetID string) bool {
+	for _, id := range r.sessions {
+		if id == targetID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *targetRegistry) describe(target *targetInfo) string {
+	if target == nil {
+		return "unknown target"
+	}
+
+	description := fmt.Sprintf("%s [targetId=%s, type=%s, url=%q, title=%q", target.label(), target.ID, target.Type, target.URL, target.Title)
+
+	if opener, exists := r.targets[target.OpenerID]; exists {
+		description += ", opener=" + opener.label()
+	} else if target.OpenerID != "" {
+		description += ", opener=" + target.OpenerID
+	}
+
+	if target.Destroyed {
+		description += ", destroyed"
+	}
+
+	return description + "]"
+}
+
+func shortURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" {
+		return value
+	}
+
+	return strings.TrimPrefix(parsed.Host, "www.") + strings.TrimSuffix(parsed.Path, "/")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const maxTimeoutCheckInterval = time.Second
+
+// timeoutError ends connection which exceeded one of its timeouts.
+type timeoutError struct {
+	reason string
+}
+
+func (e *timeoutError) Error() string {
+	return e.reason
+}
+
+// watchTimeouts closes connection which is idle for -idle-timeout, lasts longer than -max-duration
+// or waits for response to a command longer than -command-timeout.
+func (c *connection) watchTimeouts(ctxt context.Context) {
+	interval := maxTimeoutCheckInterval
+	for _, timeout := range []time.Duration{*flagIdleTimeout, *flagMaxDuration, *flagCommandTimeout} {
+		if timeout > 0 && timeout/4 < interval {
+			interval = timeout / 4
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.checkTimeouts(); err != nil {
+				fail(c.expired, err)
+				return
+			}
+
+		case <-ctxt.Done():
+			return
+		}
+	}
+}
+
+func (c *connection) checkTimeouts() error {
+	now := time.Now()
+
+	if *flagMaxDuration > 0 && now.Sub(c.started) > *flagMaxDuration {
+		return &timeoutError{fmt.Sprintf("maximum duration of %s exceeded", *flagMaxDuration)}
+	}
+
+	if idle := now.Sub(time.Unix(0, c.lastFrame.Load())); *flagIdleTimeout > 0 && idle > *flagIdleTimeout {
+		return &timeoutError{fmt.Sprintf("idle timeout: no frames for %s", *flagIdleTimeout)}
+	}
+
+	if *flagCommandTimeout == 0 {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for key, sent := range c.sent {
+		if now.Sub(sent) > *flagCommandTimeout {
+			command := c.commands[key]
+			return &timeoutError{fmt.Sprintf("command timeout: %s (id %d) not answered within %s", command.Method, command.ID, *flagCommandTimeout)}
+		}
+	}
+
+	return nil
+}
+
+func timeoutsEnabled() bool {
+	return *flagIdleTimeout > 0 || *flagMaxDuration > 0 || *flagCommandTimeout > 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type traceStream struct {
+	compressed bool
+	data       bytes.Buffer
+}
+
+// traceCollector reassembles traces, CPU profiles and heap snapshots into files loadable by DevTools.
+type traceCollector struct {
+	sync.Mutex
+	dir         string
+	counters    map[string]int
+	events      map[string][]interface{}
+	compression map[string]string
+	streams     map[string]*traceStream
+	snapshots   map[string]*bytes.Buffer
+}
+
+func newTraceCollector(connectionID string) *traceCollector {
+	return &traceCollector{
+		dir:         filepath.Join(*flagDirLogs, "artifacts", connectionID),
+		counters:    make(map[string]int),
+		events:      make(map[string][]interface{}),
+		compression: make(map[string]string),
+		streams:     make(map[string]*traceStream),
+		snapshots:   make(map[string]*bytes.Buffer),
+	}
+}
+
+// request remembers compression of traces requested with Tracing.start.
+func (t *traceCollector) request(sessionID string, request *protocolMessage) {
+	if request.Method != "Tracing.start" {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.compression[sessionID] = asString(request.Params["streamCompression"])
+	t.events[sessionID] = nil
+}
+
+// event collects Tracing and HeapProfiler events and returns path of the file once it is complete.
+func (t *traceCollector) event(sessionID string, event *protocolMessage) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	switch event.Method {
+	case "Tracing.dataCollected":
+		values, _ := event.Params["value"].([]interface{})
+		t.events[sessionID] = append(t.events[sessionID], values...)
+		event.Params["value"] = fmt.Sprintf("%d trace events", len(values))
+
+	case "Tracing.tracingComplete":
+		if handle, ok := event.Params["stream"].(string); ok {
+			t.streams[sessionID+"/"+handle] = &traceStream{compressed: t.compression[sessionID] == "gzip"}
+
+			return "", nil
+		}
+
+		events := t.events[sessionID]
+		delete(t.events, sessionID)
+
+		data, err := json.Marshal(map[string]interface{}{"traceEvents": events})
+		if err != nil {
+			return "", err
+		}
+
+		return t.write(sessionID, "trace", "json", data)
+
+	case "HeapProfiler.addHeapSnapshotChunk":
+		chunk := asString(event.Params["chunk"])
+
+		if _, exists := t.snapshots[sessionID]; !exists {
+			t.snapshots[sessionID] = new(bytes.Buffer)
+		}
+
+		t.snapshots[sessionID].WriteString(chunk)
+		event.Params["chunk"] = fmt.Sprintf("heap snapshot chunk (%s)", formatBytes(float64(len(chunk))))
+	}
+
+	return "", nil
+}
+
+// response collects IO.read streams, CPU profiles and heap snapshots and returns path of the file once it is complete.
+func (t *traceCollector) response(sessionID string, request, response *protocolMessage) (string, error) {
+	if request == nil || response.Result == nil {
+		return "", nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	switch request.Method {
+	case "IO.read":
+		key := sessionID + "/" + asString(request.Params["handle"])
+		stream, exists := t.streams[key]
+		if !exists {
+			return "", nil
+		}
+
+		data := asString(response.Result["data"])
+		if response.Result["base64Encoded"] == true {
+			decoded, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return "", fmt.Errorf("could not decode trace stream: %v", err)
+			}
+
+			stream.data.Write(decoded)
+		} else {
+			stream.data.WriteString(data)
+		}
+
+		response.Result["data"] = fmt.Sprintf("trace chunk (%s)", formatBytes(float64(len(data))))
+
+		if response.Result["eof"] != true {
+			return "", nil
+		}
+
+		delete(t.streams, key)
+
+		if stream.compressed {
+			return t.write(sessionID, "trace", "json.gz", stream.data.Bytes())
+		}
+
+		return t.write(sessionID, "trace", "json", stream.data.Bytes())
+
+	case "Profiler.stop":
+		profile, ok := response.Result["profile"]
+		if !ok {
+			return "", nil
+		}
+
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return "", err
+		}
+
+		path, err := t.write(sessionID, "profile", "cpuprofile", data)
+		if err == nil {
+			response.Result["profile"] = fmt.Sprintf("%s (%s)", path, formatBytes(float64(len(data))))
+		}
+
+		return path, err
+
+	case "HeapProfiler.takeHeapSnapshot", "HeapProfiler.stopTrackingHeapObjects":
+		snapshot, exists := t.snapshots[sessionID]
+		if !exists {
+			return "", nil
+		}
+
+		delete(t.snapshots, sessionID)
+		return t.write(sessionID, "heap", "heapsnapshot", snapshot.Bytes())
+	}
+
+	return "", nil
+}
+
+func (t *traceCollector) write(sessionID, kind, extension string, data []byte) (string, error) {
+	t.counters[sessionID+"/"+kind]++
+
+	dir := sessionDir(t.dir, sessionID)
+	path := filepath.Join(dir, fmt.Sprintf("%s-%05d.%s", kind, t.counters[sessionID+"/"+kind], extension))
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	return path, os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var debuggerURLPattern = regexp.MustCompile(`wss?(://|=)[^/"\s]+/devtools/`)
+
+// upstream describes how to reach the browser: its address and whether it is served over TLS.
+type upstream struct {
+	address   string
+	host      string
+	socket    string
+	secure    bool
+	tlsConfig *tls.Config
+	proxy     http.Handler
+	proxyOnce sync.Once
+
+	httpTransport *http.Transport
+	transportOnce sync.Once
+
+	// guarded by upstreamPool
+	healthy   bool
+	browserID string
+	active    int
+}
+
+// parseUpstream parses remote address given as host:port, unix:<path> or as http(s):// or ws(s):// URL.
+func parseUpstream(remote string) (*upstream, error) {
+	u := &upstream{address: remote, host: remote}
+
+	if path, ok := strings.CutPrefix(remote, unixPrefix); ok {
+		u.host = "localhost"
+		u.socket = path
+	} else if strings.Contains(remote, "://") {
+		parsed, err := url.Parse(remote)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote address %s: %v", remote, err)
+		}
+
+		switch parsed.Scheme {
+		case "http", "ws":
+		case "https", "wss":
+			u.secure = true
+		default:
+			return nil, fmt.Errorf("invalid remote address %s: unsupported scheme %s", remote, parsed.Scheme)
+		}
+
+		u.host = parsed.Host
+	}
+
+	if u.secure {
+		config, err := upstreamTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		u.tlsConfig = config
+	}
+
+	return u, nil
+}
+
+// upstreamTLSConfig builds client TLS configuration from -remote-* flags.
+func upstreamTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         *flagRemoteServerName,
+		InsecureSkipVerify: *flagRemoteInsecure,
+	}
+
+	if *flagRemoteCA != "" {
+		data, err := os.ReadFile(*flagRemoteCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read remote CA: %v", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("could not parse remote CA %s: no certificates found", *flagRemoteCA)
+		}
+	}
+
+	if *flagRemoteCert != "" || *flagRemoteKey != "" {
+		certificate, err := tls.LoadX509KeyPair(*flagRemoteCert, *flagRemoteKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load remote client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func (u *upstream) url(scheme, path string) string {
+	if u.secure {
+		scheme += "s"
+	}
+
+	return scheme + "://" + u.host + path
+}
+
+// httpURL returns http or https URL of given path on the browser.
+func (u *upstream) httpURL(path string) string {
+	return u.url("http", path)
+}
+
+// wsURL returns ws or wss URL of given path on the browser.
+func (u *upstream) wsURL(path string) string {
+	return u.url("ws", path)
+}
+
+// dial connects to the browser, ignoring address for upstreams reached through unix socket.
+func (u *upstream) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+
+	if u.socket != "" {
+		return dialer.DialContext(ctx, "unix", u.socket)
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// transport returns HTTP transport of the upstream, shared by all requests so that their connections are reused.
+func (u *upstream) transport() *http.Transport {
+	u.transportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = u.tlsConfig.Clone()
+		transport.DialContext = u.dial
+
+		u.httpTransport = transport
+	})
+
+	return u.httpTransport
+}
+
+func (u *upstream) dialer() *websocket.Dialer {
+	dialer := *wsDialer
+	dialer.TLSClientConfig = u.tlsConfig.Clone()
+	dialer.NetDialContext = u.dial
+
+	return &dialer
+}
+
+// reverseProxy forwards plain HTTP requests (i.e. /json endpoints) to the browser.
+func (u *upstream) reverseProxy() http.Handler {
+	u.proxyOnce.Do(func() {
+		scheme := "http"
+		if u.secure {
+			scheme = "https"
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme, Host: u.host})
+		proxy.Transport = u.transport()
+		proxy.ModifyResponse = rewriteDebuggerURLs
+
+		u.proxy = proxy
+	})
+
+	return u.proxy
+}
+
+// rewriteDebuggerURLs makes websocket URLs returned by /json endpoints use scheme the proxy is listening with.
+func rewriteDebuggerURLs(res *http.Response) error {
+	if !strings.HasPrefix(res.Request.URL.Path, "/json") {
+		return nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body = []byte(rewriteDebuggerURL(string(body), res.Request.Host))
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// rewriteDebuggerURL makes websocket URLs within value point to the proxy listening on given host.
+func rewriteDebuggerURL(value, host string) string {
+	scheme := "ws"
+	if listenScheme() == "https" {
+		scheme = "wss"
+	}
+
+	return debuggerURLPattern.ReplaceAllStringFunc(value, func(match string) string {
+		separator := "="
+		if strings.Contains(match, "://") {
+			separator = "://"
+		}
+
+		return scheme + separator + host + "/devtools/"
+	})
+}
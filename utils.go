@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 func center(message string, length int) string {
@@ -16,6 +21,41 @@ func center(message string, length int) string {
 	return strings.Repeat(" ", padding) + message + strings.Repeat(" ", length-len(message)-padding)
 }
 
+func fit(message string, length int) string {
+	if len(message) <= length {
+		return message
+	}
+
+	return truncate(message, length-3) + "..."
+}
+
+// truncate returns the longest prefix of message which has at most length bytes and does not split a character.
+func truncate(message string, length int) string {
+	if len(message) <= length {
+		return message
+	}
+
+	for length > 0 && !utf8.RuneStart(message[length]) {
+		length--
+	}
+
+	return message[:length]
+}
+
+// truncateLeft returns the longest suffix of message which has at most length bytes and does not split a character.
+func truncateLeft(message string, length int) string {
+	if len(message) <= length {
+		return message
+	}
+
+	start := len(message) - length
+	for start < len(message) && !utf8.RuneStart(message[start]) {
+		start++
+	}
+
+	return message[start:]
+}
+
 func asString(value interface{}) string {
 	if casted, ok := value.(string); ok {
 		return casted
@@ -24,6 +64,14 @@ func asString(value interface{}) string {
 	return fmt.Sprintf("%+v", value)
 }
 
+func number(values map[string]interface{}, key string) float64 {
+	if val, ok := values[key].(float64); ok {
+		return val
+	}
+
+	return 0
+}
+
 func serialize(value interface{}) string {
 
 	buff, err := json.Marshal(value)
@@ -44,11 +92,24 @@ func serialize(value interface{}) string {
 	return err.Error()
 }
 
+// decodeMessage decodes protocol message, leaving fields of unexpected types empty as the browser
+// still acts on method and id of such message.
 func decodeMessage(bytes []byte) (*protocolMessage, error) {
 	var msg protocolMessage
 
-	if err := json.Unmarshal(bytes, &msg); err != nil {
+	var typeError *json.UnmarshalTypeError
+	if err := json.Unmarshal(bytes, &msg); errors.As(err, &typeError) && typeError.Field != "" {
+		// browser accepts integral id written as a float, i.e. 3.0
+		var id struct {
+			ID json.Number `json:"id"`
+		}
 
+		if json.Unmarshal(bytes, &id) == nil {
+			if value, err := id.ID.Float64(); err == nil && value > 0 && value < 1<<53 && value == math.Trunc(value) {
+				msg.ID = uint64(value)
+			}
+		}
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -56,14 +117,150 @@ func decodeMessage(bytes []byte) (*protocolMessage, error) {
 	return &msg, nil
 }
 
-func decodeProtocolMessage(message *protocolMessage) (*protocolMessage, error) {
-	if message.IsFlatten() {
-		return message, nil
+// duplicateKey returns path of a key of JSON object which is repeated or empty string if there is none.
+// Top-level keys are matched case-insensitively by encoding/json, so they are repeated even if they differ in case.
+// Nested objects are decoded into maps and their keys have to be equal.
+func duplicateKey(data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return ""
 	}
 
-	if message.FromTargetDomain() {
-		return decodeMessage([]byte(asString(message.Params["message"])))
+	path, _ := duplicateObjectKey(decoder, "", strings.EqualFold)
+
+	return path
+}
+
+// duplicateObjectKey reads object following its opening delimiter and returns path of the first repeated key.
+func duplicateObjectKey(decoder *json.Decoder, prefix string, same func(string, string) bool) (string, error) {
+	var keys []string
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		key, _ := token.(string)
+		for _, previous := range keys {
+			if same(previous, key) {
+				return prefix + key, nil
+			}
+		}
+
+		keys = append(keys, key)
+
+		if path, err := duplicateValueKey(decoder, prefix+key+"."); path != "" || err != nil {
+			return path, err
+		}
 	}
 
-	return message, nil
+	_, err := decoder.Token()
+
+	return "", err
+}
+
+// duplicateValueKey reads value and returns path of the first repeated key of objects within it.
+func duplicateValueKey(decoder *json.Decoder, prefix string) (string, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		return duplicateObjectKey(decoder, prefix, func(a, b string) bool { return a == b })
+	case json.Delim('['):
+		for decoder.More() {
+			if path, err := duplicateValueKey(decoder, prefix); path != "" || err != nil {
+				return path, err
+			}
+		}
+
+		_, err = decoder.Token()
+	}
+
+	return "", err
+}
+
+// unwrapMessage recursively decodes Target.sendMessageToTarget and Target.receivedMessageFromTarget envelopes
+// and returns messages from the outermost to the innermost one along with sessions they were sent through.
+func unwrapMessage(message *protocolMessage) ([]sessionMessage, error) {
+	levels := []sessionMessage{{sessionID: message.SessionId, message: message}}
+
+	for message.FromTargetDomain() {
+		payload, ok := message.Params["message"].(string)
+		if !ok {
+			break
+		}
+
+		inner, err := decodeMessage([]byte(payload))
+		if err != nil {
+			return levels, err
+		}
+
+		sessionID, _ := message.Params["sessionId"].(string)
+		if sessionID == "" {
+			sessionID, _ = message.Params["targetId"].(string)
+		}
+
+		levels = append(levels, sessionMessage{sessionID: sessionID, message: inner})
+		message = inner
+	}
+
+	return levels, nil
+}
+
+// wrapMessage encodes message sent through the innermost of given sessions, wrapping it in
+// Target.receivedMessageFromTarget envelopes of the outer ones.
+func wrapMessage(levels []sessionMessage, message map[string]interface{}) ([]byte, error) {
+	for i := len(levels) - 1; i > 0; i-- {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+
+		message = map[string]interface{}{
+			"method": "Target.receivedMessageFromTarget",
+			"params": map[string]interface{}{
+				"sessionId": levels[i].sessionID,
+				"message":   string(data),
+			},
+		}
+	}
+
+	if len(levels) > 0 && levels[0].sessionID != "" {
+		message["sessionId"] = levels[0].sessionID
+	}
+
+	return json.Marshal(message)
+}
+
+// errorReply builds frames answering the innermost request with an error, acknowledging envelopes it was sent in first.
+func errorReply(levels []sessionMessage, code int64, message string) ([][]byte, error) {
+	var frames [][]byte
+
+	for i, level := range levels {
+		response := map[string]interface{}{"id": level.message.ID}
+
+		if i == len(levels)-1 {
+			response["error"] = map[string]interface{}{"code": code, "message": message}
+		} else {
+			response["result"] = map[string]interface{}{}
+		}
+
+		data, err := wrapMessage(levels[:i+1], response)
+		if err != nil {
+			return nil, err
+		}
+
+		frames = append(frames, data)
+	}
+
+	return frames, nil
+}
+
+func commandKey(sessionID string, id uint64) string {
+	return sessionID + "#" + strconv.FormatUint(id, 10)
 }
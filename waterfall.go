@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	waterfallWidth     = 60
+	waterfallURLLength = 64
+	waterfallFormat    = "%-6s %-7s %-24s %9s %9s  %-64s |%s|"
+	waterfallLegend    = "legend: . queueing, d dns, c connect, s send, w waiting, r receiving"
+)
+
+type networkRequest struct {
+	ID       string
+	URL      string
+	Method   string
+	Status   int
+	MimeType string
+	Size     float64
+	Error    string
+	started  float64
+	finished float64
+	timing   map[string]interface{}
+}
+
+type networkPhase struct {
+	start  float64
+	end    float64
+	symbol byte
+}
+
+// phases splits request into queueing, dns, connect, send, wait and receive phases based on ResourceTiming.
+func (r *networkRequest) phases() []networkPhase {
+	end := math.Max(r.finished, r.started)
+
+	if r.timing == nil {
+		return []networkPhase{{r.started, end, 'r'}}
+	}
+
+	base := number(r.timing, "requestTime")
+	offset := func(key string) float64 {
+		return base + number(r.timing, key)/1000
+	}
+
+	phases := []networkPhase{{r.started, base, '.'}}
+
+	if number(r.timing, "dnsStart") >= 0 {
+		phases = append(phases, networkPhase{offset("dnsStart"), offset("dnsEnd"), 'd'})
+	}
+
+	if number(r.timing, "connectStart") >= 0 {
+		phases = append(phases, networkPhase{offset("connectStart"), offset("connectEnd"), 'c'})
+	}
+
+	phases = append(phases,
+		networkPhase{offset("sendStart"), offset("sendEnd"), 's'},
+		networkPhase{offset("sendEnd"), offset("receiveHeadersEnd"), 'w'},
+		networkPhase{offset("receiveHeadersEnd"), math.Max(end, offset("receiveHeadersEnd")), 'r'},
+	)
+
+	return phases
+}
+
+type networkWaterfall struct {
+	sync.Mutex
+	requests map[string][]*networkRequest
+	pending  map[string]map[string]*networkRequest
+}
+
+func newNetworkWaterfall() *networkWaterfall {
+	return &networkWaterfall{
+		requests: make(map[string][]*networkRequest),
+		pending:  make(map[string]map[string]*networkRequest),
+	}
+}
+
+// observe updates waterfall of given session with Network domain events.
+func (w *networkWaterfall) observe(sessionID string, msg *protocolMessage) {
+	if !strings.HasPrefix(msg.Method, "Network.") {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if _, exists := w.pending[sessionID]; !exists {
+		w.pending[sessionID] = make(map[string]*networkRequest)
+	}
+
+	pending := w.pending[sessionID]
+	requestID := asString(msg.Params["requestId"])
+	request := pending[requestID]
+
+	switch msg.Method {
+	case "Network.requestWillBeSent":
+		if redirect, ok := msg.Params["redirectResponse"].(map[string]interface{}); ok && request != nil {
+			request.Status = int(number(redirect, "status"))
+			request.MimeType = asString(redirect["mimeType"])
+			request.timing, _ = redirect["timing"].(map[string]interface{})
+			request.finished = number(msg.Params, "timestamp")
+		}
+
+		details, _ := msg.Params["request"].(map[string]interface{})
+		request = &networkRequest{
+			ID:      requestID,
+			URL:     asString(details["url"]),
+			Method:  asString(details["method"]),
+			started: number(msg.Params, "timestamp"),
+		}
+
+		pending[requestID] = request
+		w.requests[sessionID] = append(w.requests[sessionID], request)
+
+	case "Network.responseReceived":
+		if request == nil {
+			return
+		}
+
+		response, _ := msg.Params["response"].(map[string]interface{})
+		request.Status = int(number(response, "status"))
+		request.MimeType = asString(response["mimeType"])
+		request.Size = number(response, "encodedDataLength")
+		request.timing, _ = response["timing"].(map[string]interface{})
+
+	case "Network.loadingFinished":
+		if request == nil {
+			return
+		}
+
+		request.Size = math.Max(request.Size, number(msg.Params, "encodedDataLength"))
+		request.finished = number(msg.Params, "timestamp")
+		delete(pending, requestID)
+
+	case "Network.loadingFailed":
+		if request == nil {
+			return
+		}
+
+		request.Error = asString(msg.Params["errorText"])
+		request.finished = number(msg.Params, "timestamp")
+		delete(pending, requestID)
+	}
+}
+
+// sessions returns ids of sessions that issued network requests.
+func (w *networkWaterfall) sessions() []string {
+	w.Lock()
+	defer w.Unlock()
+
+	var sessions []string
+	for sessionID := range w.requests {
+		sessions = append(sessions, sessionID)
+	}
+
+	sort.Strings(sessions)
+	return sessions
+}
+
+// forget drops all requests of given session.
+func (w *networkWaterfall) forget(sessionID string) {
+	w.Lock()
+	defer w.Unlock()
+
+	delete(w.requests, sessionID)
+	delete(w.pending, sessionID)
+}
+
+// render returns waterfall of given session, one line per request.
+func (w *networkWaterfall) render(sessionID, label string) []string {
+	w.Lock()
+	defer w.Unlock()
+
+	requests := w.requests[sessionID]
+	if len(requests) == 0 {
+		return nil
+	}
+
+	first, last := math.MaxFloat64, 0.0
+	for _, request := range requests {
+		for _, phase := range request.phases() {
+			first = math.Min(first, phase.start)
+			last = math.Max(last, phase.end)
+		}
+	}
+
+	span := math.Max(last-first, 0.001)
+	column := func(timestamp float64) int {
+		return int(math.Min(waterfallWidth-1, math.Max(0, (timestamp-first)/span*waterfallWidth)))
+	}
+
+	lines := []string{
+		fmt.Sprintf("network waterfall of %s: %d requests in %s", label, len(requests), formatDuration(span)),
+		fmt.Sprintf(waterfallFormat, "status", "method", "type", "size", "time", "url", strings.Repeat(" ", waterfallWidth)),
+	}
+
+	for _, request := range requests {
+		bar := []byte(strings.Repeat(" ", waterfallWidth))
+
+		phases := request.phases()
+		for _, phase := range phases {
+			if phase.end <= phase.start {
+				continue
+			}
+
+			for i := column(phase.start); i <= column(phase.end) && i < waterfallWidth; i++ {
+				bar[i] = phase.symbol
+			}
+		}
+
+		status := "..."
+		if request.Error != "" {
+			status = "failed"
+		} else if request.Status != 0 {
+			status = fmt.Sprintf("%d", request.Status)
+		}
+
+		duration := "-"
+		if request.finished > 0 {
+			duration = formatDuration(request.finished - request.started)
+		}
+
+		location := fit(request.URL, waterfallURLLength)
+		if request.Error != "" {
+			location = fit(request.Error+" "+request.URL, waterfallURLLength)
+		}
+
+		lines = append(lines, fmt.Sprintf(waterfallFormat, status, request.Method, fit(request.MimeType, 24), formatBytes(request.Size), duration, location, string(bar)))
+	}
+
+	return append(lines, waterfallLegend)
+}
+
+func formatDuration(seconds float64) string {
+	if seconds < 1 {
+		return fmt.Sprintf("%.1fms", seconds*1000)
+	}
+
+	return fmt.Sprintf("%.2fs", seconds)
+}
+
+func formatBytes(size float64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", size/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1fKB", size/1024)
+	}
+
+	return fmt.Sprintf("%.0fB", size)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Minimal zstd encoder (RFC 8878) for rotated logs: literals are stored raw and matches found within each block
+// are encoded with predefined FSE tables, which is enough for repetitive log lines.
+const (
+	zstdMagic           = 0xFD2FB528
+	zstdBlockSize       = 128 * 1024
+	zstdWindowLog       = 17
+	zstdMinMatch        = 4
+	zstdHashLog         = 15
+	zstdBlockRaw        = 0
+	zstdBlockCompressed = 2
+)
+
+var (
+	zstdLiteralsLengthNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthNorm    = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetNorm         = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	zstdLiteralsLengthBase = []uint32{16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLiteralsLengthBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMatchLengthBase    = []uint32{35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMatchLengthBits    = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	zstdLiteralsLengthTable = newFSETable(zstdLiteralsLengthNorm, 6)
+	zstdMatchLengthTable    = newFSETable(zstdMatchLengthNorm, 6)
+	zstdOffsetTable         = newFSETable(zstdOffsetNorm, 5)
+)
+
+// fseTable encodes symbols with finite state entropy table built from normalized distribution.
+type fseTable struct {
+	log      uint
+	nbBits   []uint8
+	baseline []uint16
+	// encode maps symbol and state of the decoder after it to the state which decodes the symbol
+	encode [][]uint16
+}
+
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	symbols := make([]int, size)
+
+	high := size - 1
+	for symbol, probability := range norm {
+		if probability == -1 {
+			symbols[high] = symbol
+			high--
+		}
+	}
+
+	position, step, mask := 0, size>>1+size>>3+3, size-1
+	for symbol, probability := range norm {
+		for i := 0; i < int(probability); i++ {
+			symbols[position] = symbol
+
+			for position = (position + step) & mask; position > high; position = (position + step) & mask {
+			}
+		}
+	}
+
+	t := &fseTable{log: log, nbBits: make([]uint8, size), baseline: make([]uint16, size), encode: make([][]uint16, len(norm))}
+
+	next := make([]int, len(norm))
+	for symbol, probability := range norm {
+		next[symbol] = int(probability)
+		if probability == -1 {
+			next[symbol] = 1
+		}
+
+		t.encode[symbol] = make([]uint16, size)
+	}
+
+	for state, symbol := range symbols {
+		x := next[symbol]
+		next[symbol]++
+
+		nbBits := int(log) - (bits.Len(uint(x)) - 1)
+		baseline := x<<nbBits - size
+		t.nbBits[state], t.baseline[state] = uint8(nbBits), uint16(baseline)
+
+		for following := baseline; following < baseline+1<<nbBits; following++ {
+			t.encode[symbol][following] = uint16(state)
+		}
+	}
+
+	return t
+}
+
+// bitWriter writes bitstream which the decoder reads backwards.
+type bitWriter struct {
+	out       []byte
+	container uint64
+	nbits     uint
+}
+
+func (w *bitWriter) add(value uint64, nbits uint) {
+	w.container |= (value & (1<<nbits - 1)) << w.nbits
+	w.nbits += nbits
+
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.container))
+		w.container >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close ends the bitstream with a marker bit so that the decoder can find where it starts.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.container))
+	}
+
+	return w.out
+}
+
+type zstdSequence struct {
+	literals, offset, match uint32
+}
+
+// zstdCompress writes zstd frame with content of reader.
+func zstdCompress(writer io.Writer, reader io.Reader) error {
+	header := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+	// no content size, checksum or dictionary, window of 128KB
+	header = append(header, 0, (zstdWindowLog-10)<<3)
+
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	current := make([]byte, zstdBlockSize)
+	n, err := io.ReadFull(reader, current)
+
+	for {
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		block := current[:n]
+		last := err != nil
+
+		if !last {
+			// block is the last one only if there is nothing more to read
+			following := make([]byte, zstdBlockSize)
+			var m int
+			m, err = io.ReadFull(reader, following)
+
+			if errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			} else {
+				if _, werr := writer.Write(zstdBlock(block, false)); werr != nil {
+					return werr
+				}
+
+				current, n = following, m
+				continue
+			}
+		}
+
+		_, err = writer.Write(zstdBlock(block, last))
+		return err
+	}
+}
+
+// zstdBlock encodes block, storing it raw if it can't be compressed.
+func zstdBlock(data []byte, last bool) []byte {
+	blockType, content := zstdBlockCompressed, zstdCompressBlock(data)
+	if content == nil || len(content) >= len(data) {
+		blockType, content = zstdBlockRaw, data
+	}
+
+	header := uint32(len(content))<<3 | uint32(blockType)<<1
+	if last {
+		header |= 1
+	}
+
+	return append([]byte{byte(header), byte(header >> 8), byte(header >> 16)}, content...)
+}
+
+// zstdCompressBlock encodes block as raw literals and sequences of matches found within it.
+func zstdCompressBlock(data []byte) []byte {
+	if len(data) < zstdMinMatch*2 {
+		return nil
+	}
+
+	var literals []byte
+	var sequences []zstdSequence
+
+	table := make([]int32, 1<<zstdHashLog)
+	anchor := 0
+
+	for i := 0; i+zstdMinMatch <= len(data); {
+		value := binary.LittleEndian.Uint32(data[i:])
+		hash := (value * 2654435761) >> (32 - zstdHashLog)
+		candidate := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(data[candidate:]) != value {
+			i++
+			continue
+		}
+
+		length := zstdMinMatch
+		for i+length < len(data) && data[candidate+length] == data[i+length] {
+			length++
+		}
+
+		literals = append(literals, data[anchor:i]...)
+		sequences = append(sequences, zstdSequence{literals: uint32(i - anchor), offset: uint32(i - candidate), match: uint32(length)})
+
+		i += length
+		anchor = i
+	}
+
+	literals = append(literals, data[anchor:]...)
+
+	out := zstdLiteralsHeader(len(literals))
+	out = append(out, literals...)
+
+	return append(out, zstdSequences(sequences)...)
+}
+
+// zstdLiteralsHeader describes raw literals section of given size.
+func zstdLiteralsHeader(size int) []byte {
+	switch {
+	case size < 32:
+		return []byte{byte(size << 3)}
+	case size < 4096:
+		return []byte{byte(size<<4) | 1<<2, byte(size >> 4)}
+	default:
+		return []byte{byte(size<<4) | 3<<2, byte(size >> 4), byte(size >> 12)}
+	}
+}
+
+// zstdSequences encodes sequences section with predefined tables.
+func zstdSequences(sequences []zstdSequence) []byte {
+	var out []byte
+
+	switch count := len(sequences); {
+	case count == 0:
+		return []byte{0}
+	case count < 128:
+		out = []byte{byte(count)}
+	case count < 0x7F00:
+		out = []byte{byte(count>>8) + 128, byte(count)}
+	default:
+		out = []byte{255, byte(count - 0x7F00), byte((count - 0x7F00) >> 8)}
+	}
+
+	// all tables are predefined
+	out = append(out, 0)
+
+	type codes struct {
+		literals, match, offset                uint8
+		literalsExtra, matchExtra, offsetExtra uint32
+		literalsBits, matchBits, offsetBits    uint
+	}
+
+	encoded := make([]codes, len(sequences))
+	for i, sequence := range sequences {
+		c := &encoded[i]
+		c.literals, c.literalsExtra, c.literalsBits = zstdLengthCode(sequence.literals, 16, 0, zstdLiteralsLengthBase, zstdLiteralsLengthBits)
+		c.match, c.matchExtra, c.matchBits = zstdLengthCode(sequence.match, 32, 3, zstdMatchLengthBase, zstdMatchLengthBits)
+
+		// offsets are never repeated, values up to 3 would refer to repeated offsets
+		value := sequence.offset + 3
+		c.offset = uint8(bits.Len32(value) - 1)
+		c.offsetExtra, c.offsetBits = value-1<<c.offset, uint(c.offset)
+	}
+
+	var w bitWriter
+
+	last := encoded[len(encoded)-1]
+	literalsState := zstdLiteralsLengthTable.encode[last.literals][0]
+	matchState := zstdMatchLengthTable.encode[last.match][0]
+	offsetState := zstdOffsetTable.encode[last.offset][0]
+
+	w.add(uint64(last.literalsExtra), last.literalsBits)
+	w.add(uint64(last.matchExtra), last.matchBits)
+	w.add(uint64(last.offsetExtra), last.offsetBits)
+
+	// decoder reads the bitstream backwards, so sequences are written from the last one
+	for i := len(encoded) - 2; i >= 0; i-- {
+		c := encoded[i]
+
+		offsetState = zstdOffsetTable.transition(&w, c.offset, offsetState)
+		matchState = zstdMatchLengthTable.transition(&w, c.match, matchState)
+		literalsState = zstdLiteralsLengthTable.transition(&w, c.literals, literalsState)
+
+		w.add(uint64(c.literalsExtra), c.literalsBits)
+		w.add(uint64(c.matchExtra), c.matchBits)
+		w.add(uint64(c.offsetExtra), c.offsetBits)
+	}
+
+	w.add(uint64(matchState), zstdMatchLengthTable.log)
+	w.add(uint64(offsetState), zstdOffsetTable.log)
+	w.add(uint64(literalsState), zstdLiteralsLengthTable.log)
+
+	return append(out, w.close()...)
+}
+
+// transition writes bits leading decoder from state decoding symbol to the following state and returns the former.
+func (t *fseTable) transition(w *bitWriter, symbol uint8, following uint16) uint16 {
+	state := t.encode[symbol][following]
+	w.add(uint64(following-t.baseline[state]), uint(t.nbBits[state]))
+
+	return state
+}
+
+// zstdLengthCode returns code of literals or match length along with its extra bits.
+// Lengths below direct are coded as themselves decreased by bias.
+func zstdLengthCode(length, direct, bias uint32, base []uint32, extra []uint8) (uint8, uint32, uint) {
+	if length-bias < direct {
+		return uint8(length - bias), 0, 0
+	}
+
+	code := len(base) - 1
+	for base[code] > length {
+		code--
+	}
+
+	return uint8(direct) + uint8(code), length - base[code], uint(extra[code])
+}
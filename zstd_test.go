@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestZstdCompressDecodedByZstd(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	var log strings.Builder
+	for i := 0; log.Len() < 3*zstdBlockSize; i++ {
+		fmt.Fprintf(&log, `time="2026-10-19T12:00:%02d" level=info msg="{\"id\":%d,\"method\":\"Page.navigate\"}"`+"\n", i%60, i)
+	}
+
+	random := make([]byte, 2*zstdBlockSize+7)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"empty":    nil,
+		"short":    []byte("short"),
+		"log":      []byte(log.String()),
+		"block":    []byte(log.String()[:zstdBlockSize]),
+		"random":   random,
+		"repeated": bytes.Repeat([]byte{'a'}, zstdBlockSize+1),
+	}
+
+	for name, input := range inputs {
+		var compressed bytes.Buffer
+		if err := zstdCompress(&compressed, bytes.NewReader(input)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		cmd := exec.Command(zstd, "-d", "-c")
+		cmd.Stdin = &compressed
+
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: could not decompress: %v", name, err)
+		}
+
+		if !bytes.Equal(output, input) {
+			t.Fatalf("%s: decompressed %d bytes differ from %d compressed", name, len(output), len(input))
+		}
+	}
+}